@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+// bumpFieldRegexp matches top-level "version:" and "build:" lines of a pkgen.
+// The groups are the key, the value, and any trailing comment (with leading whitespace).
+var bumpFieldRegexp = regexp.MustCompile(`(?m)^(version|build):[ \t]*([^#\n]*?)([ \t]*(?:#[^\n]*)?)$`)
+
+// bumpPkgen updates the version of a pkgen file.
+// If version is empty, the build number is incremented.
+// Otherwise, the version is set and the build number is reset to 0.
+// Only the values of the top-level version and build fields are rewritten, so comments and formatting are preserved.
+func bumpPkgen(path string, version string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rpg, err := pkgen.UnmarshalPkgen(bytes.NewReader(dat))
+	if err != nil {
+		return err
+	}
+
+	// find fields
+	fields := map[string][]int{}
+	for _, m := range bumpFieldRegexp.FindAllSubmatchIndex(dat, -1) {
+		key := string(dat[m[2]:m[3]])
+		if _, ok := fields[key]; ok {
+			return fmt.Errorf("duplicate %s field", key)
+		}
+		fields[key] = m
+	}
+	if fields["version"] == nil {
+		return errors.New("version field not found")
+	}
+
+	// update version
+	expect := *rpg
+	if version == "" {
+		expect.Build++
+	} else {
+		expect.Version = version
+		expect.Build = 0
+	}
+
+	// rewrite values
+	type edit struct {
+		start, end int
+		val        string
+	}
+	edits := []edit{}
+	if version != "" {
+		m := fields["version"]
+		edits = append(edits, edit{m[4], m[5], strconv.Quote(expect.Version)})
+	}
+	build := strconv.FormatUint(uint64(expect.Build), 10)
+	switch m := fields["build"]; {
+	case m != nil:
+		edits = append(edits, edit{m[4], m[5], build})
+	case expect.Build != 0:
+		// add build field after version line
+		end := fields["version"][1]
+		edits = append(edits, edit{end, end, "\nbuild: " + build})
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	out := append([]byte{}, dat...)
+	for _, e := range edits {
+		// edits are applied last first, so that offsets stay valid
+		out = append(out[:e.start], append([]byte(e.val), out[e.end:]...)...)
+	}
+
+	// check that the result re-parses to the expected pkgen
+	chk, err := pkgen.UnmarshalPkgen(bytes.NewReader(out))
+	if err != nil {
+		return fmt.Errorf("updated pkgen is invalid: %s", err.Error())
+	}
+	if !reflect.DeepEqual(chk, &expect) {
+		return fmt.Errorf("failed to update pkgen: got version %q build %d", chk.Version, chk.Build)
+	}
+
+	return ioutil.WriteFile(path, out, info.Mode())
+}
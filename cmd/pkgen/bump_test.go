@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBumpPkgen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bump")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pkgen.yaml")
+	src := `# example pkgen
+packages:
+  example:
+    dependencies: [musl] # runtime deps
+version: 1.0   # upstream version
+build: 2 # bumped on rebuilds
+sources:
+  - https://example.com/example-{{.Version}}.tar.gz
+script:
+  # build it
+  - make
+builddependencies: [build-meta]
+`
+	err = ioutil.WriteFile(path, []byte(src), 0644)
+	if err != nil {
+		t.Fatalf("failed to write pkgen: %s", err.Error())
+	}
+
+	tbl := []struct {
+		version string
+		lines   map[int]string
+	}{
+		{"", map[int]string{5: "build: 3 # bumped on rebuilds"}},
+		{"", map[int]string{5: "build: 4 # bumped on rebuilds"}},
+		{"1.1", map[int]string{
+			4: `version: "1.1"   # upstream version`,
+			5: "build: 0 # bumped on rebuilds",
+		}},
+		{"", map[int]string{
+			4: `version: "1.1"   # upstream version`,
+			5: "build: 1 # bumped on rebuilds",
+		}},
+	}
+	for _, v := range tbl {
+		err = bumpPkgen(path, v.version)
+		if err != nil {
+			t.Fatalf("failed to bump pkgen: %s", err.Error())
+		}
+		dat, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read pkgen: %s", err.Error())
+		}
+
+		// only the bumped lines differ from the original
+		expect := strings.Split(src, "\n")
+		for i, l := range v.lines {
+			expect[i] = l
+		}
+		if lines := strings.Split(string(dat), "\n"); !reflect.DeepEqual(lines, expect) {
+			t.Errorf("expected:\n%s\nbut got:\n%s", strings.Join(expect, "\n"), dat)
+		}
+	}
+}
+
+func TestBumpPkgenAddBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bump")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pkgen.yaml")
+	err = ioutil.WriteFile(path, []byte("packages:\n  example: {}\nversion: \"1.0\" # comment\nscript: [make]\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write pkgen: %s", err.Error())
+	}
+	err = bumpPkgen(path, "")
+	if err != nil {
+		t.Fatalf("failed to bump pkgen: %s", err.Error())
+	}
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read pkgen: %s", err.Error())
+	}
+	if expect := "packages:\n  example: {}\nversion: \"1.0\" # comment\nbuild: 1\nscript: [make]\n"; string(dat) != expect {
+		t.Errorf("expected:\n%s\nbut got:\n%s", expect, dat)
+	}
+}
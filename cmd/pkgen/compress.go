@@ -0,0 +1,35 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// nopWriteCloser is an io.WriteCloser with a no-op Close.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// compressors is a set of functions which wrap an io.Writer with compression, keyed by file extension.
+// Closing the returned io.WriteCloser flushes the compressor, but does not close the underlying io.Writer.
+var compressors = map[string]func(io.Writer) (io.WriteCloser, error){
+	".tar": func(w io.Writer) (io.WriteCloser, error) {
+		return nopWriteCloser{w}, nil
+	},
+	".gz": func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+	".xz": func(w io.Writer) (io.WriteCloser, error) {
+		return xz.NewWriter(w)
+	},
+	".zst": func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w)
+	},
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func TestCompressors(t *testing.T) {
+	decompressors := map[string]func(io.Reader) (io.Reader, error){
+		".tar": func(r io.Reader) (io.Reader, error) {
+			return r, nil
+		},
+		".gz": func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		".xz": func(r io.Reader) (io.Reader, error) {
+			return xz.NewReader(r)
+		},
+		".zst": func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+	}
+	content := []byte("hello world\n")
+	for ext, compress := range compressors {
+		// write compressed tar
+		var buf bytes.Buffer
+		w, err := compress(&buf)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", ext, err.Error())
+			continue
+		}
+		tw := tar.NewWriter(w)
+		err = tw.WriteHeader(&tar.Header{
+			Name: "hello.txt",
+			Mode: 0600,
+			Size: int64(len(content)),
+		})
+		if err == nil {
+			_, err = tw.Write(content)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", ext, err.Error())
+			continue
+		}
+
+		// read it back
+		decompress, ok := decompressors[ext]
+		if !ok {
+			t.Errorf("%s: no decompressor", ext)
+			continue
+		}
+		r, err := decompress(&buf)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", ext, err.Error())
+			continue
+		}
+		tr := tar.NewReader(r)
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", ext, err.Error())
+			continue
+		}
+		dat, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", ext, err.Error())
+			continue
+		}
+		if hdr.Name != "hello.txt" || !bytes.Equal(dat, content) {
+			t.Errorf("%s: expected hello.txt with %q but got %s with %q", ext, content, hdr.Name, dat)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"gitlab.com/panux/builder/pkgen/build"
+)
+
+// pkgenName returns the name of the pkgen for an entry.
+func pkgenName(ent *build.RawPkent) string {
+	return filepath.Base(filepath.Dir(ent.Path))
+}
+
+// pkgenGraph computes the direct dependencies between the pkgens in a RawPackageIndex.
+// A pkgen depends on the pkgens providing its build dependencies, and on those providing the dependencies of its packages.
+func pkgenGraph(rpi build.RawPackageIndex) (map[string][]string, error) {
+	g := map[string][]string{}
+	for _, name := range rpi.List() {
+		ent := rpi[name]
+
+		// collect dependency package names
+		deps := append([]string{}, ent.Pkgen.BuildDependencies...)
+		for _, p := range ent.Pkgen.Packages {
+			deps = append(deps, p.Dependencies...)
+		}
+
+		// map packages to pkgens
+		dset := map[string]struct{}{}
+		for _, d := range deps {
+			dent, ok := rpi[d]
+			if !ok {
+				return nil, build.ErrPkgNotFound{PkgName: d}
+			}
+			if dn := pkgenName(dent); dn != name {
+				dset[dn] = struct{}{}
+			}
+		}
+		dl := []string{}
+		for d := range dset {
+			dl = append(dl, d)
+		}
+		sort.Strings(dl)
+		g[name] = dl
+	}
+	return g, nil
+}
+
+// graphComponents finds the strongly connected components of a graph (Tarjan's algorithm).
+// Returns a map of node to component number.
+func graphComponents(g map[string][]string) map[string]int {
+	index := map[string]int{}
+	low := map[string]int{}
+	onStack := map[string]bool{}
+	stack := []string{}
+	comp := map[string]int{}
+	n, nc := 0, 0
+
+	var connect func(v string)
+	connect = func(v string) {
+		index[v] = n
+		low[v] = n
+		n++
+		stack = append(stack, v)
+		onStack[v] = true
+		for _, w := range g[v] {
+			if _, ok := index[w]; !ok {
+				connect(w)
+				if low[w] < low[v] {
+					low[v] = low[w]
+				}
+			} else if onStack[w] && index[w] < low[v] {
+				low[v] = index[w]
+			}
+		}
+		if low[v] == index[v] {
+			for {
+				w := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[w] = false
+				comp[w] = nc
+				if w == v {
+					break
+				}
+			}
+			nc++
+		}
+	}
+
+	names := make([]string, 0, len(g))
+	for v := range g {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+	for _, v := range names {
+		if _, ok := index[v]; !ok {
+			connect(v)
+		}
+	}
+	return comp
+}
+
+// writeDOT writes the pkgen dependency graph of a RawPackageIndex in Graphviz DOT format.
+// Bootstrap pkgens are drawn dashed, and dependencies which are part of a cycle are drawn in red.
+func writeDOT(w io.Writer, rpi build.RawPackageIndex) error {
+	g, err := pkgenGraph(rpi)
+	if err != nil {
+		return err
+	}
+	comp := graphComponents(g)
+
+	_, err = fmt.Fprintln(w, "digraph pkgens {")
+	if err != nil {
+		return err
+	}
+	for _, name := range rpi.List() {
+		attrs := ""
+		if rpi[name].Pkgen.Builder == "bootstrap" {
+			attrs = " [style=dashed]"
+		}
+		_, err = fmt.Fprintf(w, "\t%q%s;\n", name, attrs)
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range rpi.List() {
+		for _, d := range g[name] {
+			attrs := ""
+			if comp[d] == comp[name] {
+				attrs = " [color=red]"
+			}
+			_, err = fmt.Fprintf(w, "\t%q -> %q%s;\n", name, d, attrs)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err = fmt.Fprintln(w, "}")
+	return err
+}
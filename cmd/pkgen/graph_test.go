@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+
+	"gitlab.com/panux/builder/pkgen"
+	"gitlab.com/panux/builder/pkgen/build"
+)
+
+// testIndex creates a RawPackageIndex from a set of pkgens keyed by pkgen name.
+func testIndex(pkgens map[string]*pkgen.RawPackageGenerator) build.RawPackageIndex {
+	rpi := build.RawPackageIndex{}
+	for name, rpg := range pkgens {
+		ent := &build.RawPkent{
+			Path:  name + "/pkgen.yaml",
+			Pkgen: rpg,
+		}
+		for p := range rpg.Packages {
+			rpi[p] = ent
+		}
+		rpi[name] = ent
+	}
+	return rpi
+}
+
+func TestWriteDOT(t *testing.T) {
+	rpi := testIndex(map[string]*pkgen.RawPackageGenerator{
+		"musl": {
+			Packages: map[string]pkgen.Package{"musl": {}, "musl-dev": {Dependencies: []string{"musl"}}},
+			Builder:  "bootstrap",
+		},
+		"zlib": {
+			Packages:          map[string]pkgen.Package{"zlib": {Dependencies: []string{"musl"}}},
+			BuildDependencies: []string{"musl-dev"},
+		},
+		"a": {
+			Packages:          map[string]pkgen.Package{"a": {}},
+			BuildDependencies: []string{"b", "zlib"},
+		},
+		"b": {
+			Packages:          map[string]pkgen.Package{"b": {}},
+			BuildDependencies: []string{"a"},
+		},
+	})
+	var buf bytes.Buffer
+	err := writeDOT(&buf, rpi)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	edges := map[string]string{}
+	for _, m := range regexp.MustCompile(`"(\S+)" -> "(\S+)"(.*);`).FindAllStringSubmatch(buf.String(), -1) {
+		edges[m[1]+"->"+m[2]] = m[3]
+	}
+	expect := map[string]string{
+		"zlib->musl": "",
+		"a->b":       " [color=red]",
+		"a->zlib":    "",
+		"b->a":       " [color=red]",
+	}
+	if len(edges) != len(expect) {
+		t.Errorf("expected %d edges but got %d in:\n%s", len(expect), len(edges), buf.String())
+	}
+	for e, attrs := range expect {
+		if a, ok := edges[e]; !ok || a != attrs {
+			t.Errorf("expected edge %s with attributes %q in:\n%s", e, attrs, buf.String())
+		}
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`"musl" [style=dashed];`)) {
+		t.Errorf("bootstrap node not styled in:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+// pkgenInfo is the info about a pkgen printed by "pkgen info --json".
+type pkgenInfo struct {
+	// File is the path of the pkgen.
+	File string `json:"file"`
+
+	// Packages is the sorted list of packages generated by the pkgen.
+	Packages []string `json:"packages"`
+
+	// Version is the full version of the packages.
+	Version string `json:"version"`
+
+	// Builder is the builder used for the pkgen.
+	Builder pkgen.Builder `json:"builder"`
+
+	// BuildDependencies is the set of build dependencies.
+	BuildDependencies []string `json:"buildDependencies"`
+
+	// Sources is the list of preprocessed source URLs.
+	Sources []string `json:"sources"`
+
+	// Cross is whether the pkgen supports cross compilation.
+	Cross bool `json:"cross"`
+}
+
+// loadInfo loads and preprocesses a pkgen, and returns info about it.
+func loadInfo(path string, hostarch pkgen.Arch, buildarch pkgen.Arch) (pkgenInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return pkgenInfo{}, err
+	}
+	defer f.Close()
+	rpg, err := pkgen.UnmarshalPkgen(f)
+	if err != nil {
+		return pkgenInfo{}, err
+	}
+	pg, err := rpg.Preprocess(hostarch, buildarch, false)
+	if err != nil {
+		return pkgenInfo{}, err
+	}
+	srcs := make([]string, len(pg.Sources))
+	for i, v := range pg.Sources {
+		srcs[i] = v.String()
+	}
+	bdeps := pg.BuildDependencies
+	if bdeps == nil {
+		bdeps = []string{}
+	}
+	return pkgenInfo{
+		File:              path,
+		Packages:          pg.ListPackages(),
+		Version:           pg.Version,
+		Builder:           pg.Builder,
+		BuildDependencies: bdeps,
+		Sources:           srcs,
+		Cross:             pg.Cross,
+	}, nil
+}
+
+// writeInfoJSON writes a JSON array with the info about each pkgen.
+func writeInfoJSON(w io.Writer, files []string, hostarch pkgen.Arch, buildarch pkgen.Arch) error {
+	infos := make([]pkgenInfo, len(files))
+	for i, v := range files {
+		info, err := loadInfo(v, hostarch, buildarch)
+		if err != nil {
+			return err
+		}
+		infos[i] = info
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(infos)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+func TestWriteInfoJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "info")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pkgen.yaml")
+	err = ioutil.WriteFile(path, []byte(`
+packages:
+  example:
+    dependencies: [musl]
+  example-dev:
+    dependencies: [example]
+version: "1.0"
+build: 2
+sources:
+  - https://example.com/example-{{.Version}}.tar.gz
+  - '{{ if iscross }}https://example.com/cross.patch{{ end }}'
+script:
+  - make
+builddependencies: [build-meta]
+builder: docker
+cross: true
+`), 0644)
+	if err != nil {
+		t.Fatalf("failed to write pkgen: %s", err.Error())
+	}
+
+	var buf bytes.Buffer
+	err = writeInfoJSON(&buf, []string{path}, pkgen.Archx86_64, pkgen.Archx86_64)
+	if err != nil {
+		t.Fatalf("failed to write info: %s", err.Error())
+	}
+	var infos []map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &infos)
+	if err != nil {
+		t.Fatalf("failed to decode info: %s", err.Error())
+	}
+	expect := []map[string]interface{}{{
+		"file":              path,
+		"packages":          []interface{}{"example", "example-dev"},
+		"version":           "1.0-2",
+		"builder":           "docker",
+		"buildDependencies": []interface{}{"build-meta"},
+		"sources":           []interface{}{"https://example.com/example-1.0.tar.gz"},
+		"cross":             true,
+	}}
+	if !reflect.DeepEqual(infos, expect) {
+		t.Errorf("expected %v but got %v", expect, infos)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+// lintIssue is a problem found in a pkgen by lintPkgen.
+type lintIssue struct {
+	// File is the path of the pkgen.
+	File string
+
+	// Error is whether the issue is an error (as opposed to a warning).
+	Error bool
+
+	// Msg is a description of the issue.
+	Msg string
+}
+
+func (li lintIssue) String() string {
+	lvl := "warning"
+	if li.Error {
+		lvl = "error"
+	}
+	return fmt.Sprintf("%s: %s: %s", li.File, lvl, li.Msg)
+}
+
+// lintPkgen checks a pkgen for problems.
+// The pkgen is preprocessed for harch if supported, otherwise for the first arch it supports.
+// The File field of the returned issues is not set.
+func lintPkgen(rpg *pkgen.RawPackageGenerator, harch pkgen.Arch) []lintIssue {
+	issues := []lintIssue{}
+	errorf := func(format string, args ...interface{}) {
+		issues = append(issues, lintIssue{Error: true, Msg: fmt.Sprintf(format, args...)})
+	}
+	warnf := func(format string, args ...interface{}) {
+		issues = append(issues, lintIssue{Msg: fmt.Sprintf(format, args...)})
+	}
+
+	// check basic fields
+	err := rpg.Validate()
+	if verr, ok := err.(pkgen.ValidationError); ok {
+		for _, e := range verr {
+			errorf("%s", e.Error())
+		}
+		return issues
+	} else if err != nil {
+		errorf("%s", err.Error())
+		return issues
+	}
+
+	// select arch to preprocess with
+	arch := harch
+	if !rpg.Arch.Supports(arch) {
+		archs := rpg.Arch.Expand()
+		if len(archs) == 0 {
+			errorf("no supported arches in %v", rpg.Arch)
+			return issues
+		}
+		warnf("host arch %s not supported, checking with %s", harch, archs[0])
+		arch = archs[0]
+	}
+
+	// preprocess
+	pg, err := rpg.Preprocess(arch, arch, false)
+	if err != nil {
+		errorf("failed to preprocess: %s", err.Error())
+		return issues
+	}
+
+	// check sources
+	for _, s := range pg.Sources {
+		switch s.Scheme {
+		case "http":
+			if s.Query().Get("sha256sum") == "" {
+				errorf("insecure source %q is missing a sha256sum", s.String())
+			}
+		case "https", "file":
+		default:
+			warnf("source %q uses unrecognized protocol %q", s.String(), s.Scheme)
+		}
+	}
+
+	return issues
+}
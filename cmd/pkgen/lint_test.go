@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+func TestLintPkgen(t *testing.T) {
+	tbl := []struct {
+		rpg    pkgen.RawPackageGenerator
+		errors int
+	}{
+		{
+			rpg: pkgen.RawPackageGenerator{
+				Packages: map[string]pkgen.Package{"example": {}},
+				Version:  "1.0",
+				Script:   []string{"make"},
+				Sources: []string{
+					"https://example.com/example.tar.gz",
+					"http://example.com/example.patch?sha256sum=e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+				},
+			},
+			errors: 0,
+		},
+		{
+			rpg: pkgen.RawPackageGenerator{
+				Packages: map[string]pkgen.Package{"example": {}},
+				Version:  "1.0",
+				Script:   []string{"make"},
+				Sources:  []string{"http://example.com/example.tar.gz"},
+			},
+			errors: 1,
+		},
+		{
+			rpg: pkgen.RawPackageGenerator{
+				Packages: map[string]pkgen.Package{"example": {}},
+				Version:  "1.0",
+				Script:   []string{"make"},
+				Builder:  "weird",
+			},
+			errors: 1,
+		},
+		{
+			rpg:    pkgen.RawPackageGenerator{},
+			errors: 3,
+		},
+	}
+	for i, v := range tbl {
+		n := 0
+		for _, is := range lintPkgen(&v.rpg, pkgen.Archx86_64) {
+			if is.Error {
+				n++
+			}
+		}
+		if n != v.errors {
+			t.Errorf("case %d: expected %d errors but got %d", i, v.errors, n)
+		}
+	}
+}
@@ -2,17 +2,18 @@ package main
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"syscall"
 	"text/template"
@@ -20,6 +21,7 @@ import (
 	"github.com/Masterminds/sprig"
 	"github.com/urfave/cli"
 	"gitlab.com/panux/builder/pkgen"
+	"gitlab.com/panux/builder/pkgen/build"
 	makefile "gitlab.com/panux/go-makefile"
 	"golang.org/x/tools/godoc/vfs"
 )
@@ -63,6 +65,10 @@ func main() {
 					Value: prettyInfo,
 					Usage: "template to use for info, args passed as .",
 				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print info as JSON instead of using the template",
+				},
 				cli.StringFlag{
 					Name:  "hostarch",
 					Value: harch.String(),
@@ -75,6 +81,17 @@ func main() {
 				},
 			},
 			Action: func(ctx *cli.Context) error {
+				if ctx.Bool("json") {
+					hostarch, buildarch, err := archFlags(ctx)
+					if err != nil {
+						return cli.NewExitError(err, 65)
+					}
+					err = writeInfoJSON(ctx.App.Writer, ctx.Args(), hostarch, buildarch)
+					if err != nil {
+						return cli.NewExitError(err, 65)
+					}
+					return nil
+				}
 				tmpl, err := template.New("info").
 					Funcs(sprig.TxtFuncMap()).
 					Funcs(
@@ -85,20 +102,21 @@ func main() {
 							"unmarshal": func(r io.Reader) (*pkgen.RawPackageGenerator, error) {
 								return pkgen.UnmarshalPkgen(r)
 							},
-							"arch": func(name string) (a pkgen.Arch, err error) {
-								a = pkgen.Arch(name)
-								if !a.Supported() {
-									err = fmt.Errorf("unsupported arch %q", name)
+							"arch": func(name string) (pkgen.Arch, error) {
+								a, err := pkgen.ParseArch(name)
+								if err != nil {
+									return "", fmt.Errorf("unsupported arch %q", name)
 								}
-								return
+								return a, nil
 							},
 							"preprocess": func(rpg *pkgen.RawPackageGenerator, bootstrap bool, archs ...pkgen.Arch) (*pkgen.PackageGenerator, error) {
 								switch len(archs) {
 								case 0:
-									archs = []pkgen.Arch{
-										pkgen.Arch(ctx.String("hostarch")),
-										pkgen.Arch(ctx.String("buildarch")),
+									hostarch, buildarch, err := archFlags(ctx)
+									if err != nil {
+										return nil, err
 									}
+									archs = []pkgen.Arch{hostarch, buildarch}
 								case 1:
 									archs = []pkgen.Arch{archs[0], archs[0]}
 								case 2:
@@ -116,6 +134,119 @@ func main() {
 				return tmpl.Execute(ctx.App.Writer, []string(ctx.Args()))
 			},
 		},
+		cli.Command{
+			Name:  "lint",
+			Usage: "check pkgens for problems",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) == 0 {
+					return cli.NewExitError("no pkgens specified", 65)
+				}
+				pkgs := map[string]string{}
+				nerr := 0
+				for _, file := range ctx.Args() {
+					issues := func() []lintIssue {
+						f, err := os.Open(file)
+						if err != nil {
+							return []lintIssue{{Error: true, Msg: err.Error()}}
+						}
+						defer f.Close()
+						rpg, err := pkgen.UnmarshalPkgen(f)
+						if err != nil {
+							return []lintIssue{{Error: true, Msg: err.Error()}}
+						}
+						issues := lintPkgen(rpg, harch)
+						names := []string{}
+						for p := range rpg.Packages {
+							names = append(names, p)
+						}
+						sort.Strings(names)
+						for _, p := range names {
+							if prev, ok := pkgs[p]; ok {
+								issues = append(issues, lintIssue{
+									Error: true,
+									Msg:   fmt.Sprintf("package %q is also defined in %s", p, prev),
+								})
+								continue
+							}
+							pkgs[p] = file
+						}
+						return issues
+					}()
+					for _, v := range issues {
+						v.File = file
+						if v.Error {
+							nerr++
+						}
+						fmt.Fprintln(ctx.App.Writer, v.String())
+					}
+				}
+				if nerr > 0 {
+					return cli.NewExitError(fmt.Sprintf("found %d errors", nerr), 65)
+				}
+				return nil
+			},
+		},
+		cli.Command{
+			Name:      "bump",
+			Usage:     "increment the build number or set the version of pkgens",
+			ArgsUsage: "[--build|--version X] <files...>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "build",
+					Usage: "increment the build number (default)",
+				},
+				cli.StringFlag{
+					Name:  "version",
+					Usage: "set the version (resets the build number)",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) == 0 {
+					return cli.NewExitError("no pkgens specified", 65)
+				}
+				if ctx.Bool("build") && ctx.String("version") != "" {
+					return cli.NewExitError("--build and --version are mutually exclusive", 65)
+				}
+				for _, file := range ctx.Args() {
+					err := bumpPkgen(file, ctx.String("version"))
+					if err != nil {
+						return cli.NewExitError(fmt.Errorf("%s: %s", file, err.Error()), 65)
+					}
+				}
+				return nil
+			},
+		},
+		cli.Command{
+			Name:  "graph",
+			Usage: "print the dependency graph of a directory of pkgens in Graphviz DOT format",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "check",
+					Usage: "only check that there are no build dependency cycles (no graph is printed)",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) != 1 {
+					return cli.NewExitError("wrong number of arguments", 65)
+				}
+				rpi, err := build.IndexDir(vfs.OS(ctx.Args()[0]))
+				if err != nil {
+					return cli.NewExitError(err, 65)
+				}
+				if ctx.Bool("check") {
+					err = rpi.CheckBuildCycles()
+					if err != nil {
+						return cli.NewExitError(err, 65)
+					}
+					return nil
+				}
+				err = writeDOT(ctx.App.Writer, rpi)
+				if err != nil {
+					return cli.NewExitError(err, 65)
+				}
+				return nil
+			},
+		},
 		cli.Command{
 			Name:  "makefile",
 			Usage: "generate a makefile for building the packages",
@@ -139,27 +270,15 @@ func main() {
 					Name:  "bootstrap",
 					Usage: "whether to create a bootstrap makefile",
 				},
+				cli.BoolFlag{
+					Name:  "check",
+					Usage: "only check that the makefile can be generated (no file is written)",
+				},
 			},
 			Action: func(ctx *cli.Context) (err error) {
 				if len(ctx.Args()) != 1 {
 					return cli.NewExitError("wrong number of arguments", 65)
 				}
-				f, err := os.OpenFile(ctx.String("makefile"), os.O_CREATE|os.O_WRONLY, 0600)
-				if err != nil {
-					return cli.NewExitError(err, 65)
-				}
-				go func() { // do cancel w/ file f
-					<-cctx.Done()
-					f.Close()
-				}()
-				defer func() {
-					cerr := f.Close()
-					if cerr != nil {
-						if err == nil {
-							err = cli.NewExitError(cerr, 65)
-						}
-					}
-				}()
 				inf, err := os.Open(ctx.Args()[0])
 				if err != nil {
 					return cli.NewExitError(err, 65)
@@ -173,14 +292,38 @@ func main() {
 				if err != nil {
 					return cli.NewExitError(err, 65)
 				}
-				pg, err := rpg.Preprocess(
-					pkgen.Arch(ctx.String("hostarch")),
-					pkgen.Arch(ctx.String("buildarch")),
-					ctx.Bool("bootstrap"),
-				)
+				hostarch, buildarch, err := archFlags(ctx)
 				if err != nil {
 					return cli.NewExitError(err, 65)
 				}
+				pg, err := rpg.Preprocess(hostarch, buildarch, ctx.Bool("bootstrap"))
+				if err != nil {
+					return cli.NewExitError(err, 65)
+				}
+				if ctx.Bool("check") {
+					_, err = pg.GenFullMakefile(pkgen.DefaultVars).WriteTo(ioutil.Discard)
+					if err != nil {
+						return cli.NewExitError(err, 65)
+					}
+					fmt.Fprintf(ctx.App.Writer, "%s: ok\n", ctx.Args()[0])
+					return nil
+				}
+				f, err := os.OpenFile(ctx.String("makefile"), os.O_CREATE|os.O_WRONLY, 0600)
+				if err != nil {
+					return cli.NewExitError(err, 65)
+				}
+				go func() { // do cancel w/ file f
+					<-cctx.Done()
+					f.Close()
+				}()
+				defer func() {
+					cerr := f.Close()
+					if cerr != nil {
+						if err == nil {
+							err = cli.NewExitError(cerr, 65)
+						}
+					}
+				}()
 				_, err = pg.GenFullMakefile(pkgen.DefaultVars).WriteTo(f)
 				if err != nil {
 					return cli.NewExitError(err, 65)
@@ -195,7 +338,7 @@ func main() {
 				cli.StringFlag{
 					Name:  "tar, f",
 					Value: "src.tar",
-					Usage: "tar file to write to (supports gz if extension present)",
+					Usage: "tar file to write to (supports gz, xz, and zst if extension present)",
 				},
 				cli.StringFlag{
 					Name:  "hostarch",
@@ -223,10 +366,8 @@ func main() {
 					return cli.NewExitError("wrong number of arguments", 65)
 				}
 				ext := filepath.Ext(ctx.String("tar"))
-				switch ext {
-				case ".tar":
-				case ".gz":
-				default:
+				compress, ok := compressors[ext]
+				if !ok {
 					return cli.NewExitError(fmt.Errorf("Unsupported extension %q in %q", ext, ctx.String("tar")), 65)
 				}
 				// load & preprocess pkgen
@@ -243,37 +384,15 @@ func main() {
 				if err != nil {
 					return cli.NewExitError(err, 65)
 				}
-				pg, err := rpg.Preprocess(
-					pkgen.Arch(ctx.String("hostarch")),
-					pkgen.Arch(ctx.String("buildarch")),
-					ctx.Bool("bootstrap"),
-				)
+				hostarch, buildarch, err := archFlags(ctx)
 				if err != nil {
 					return cli.NewExitError(err, 65)
 				}
-				// prep writer for tar
-				tf, err := os.OpenFile(ctx.String("tar"), os.O_CREATE|os.O_WRONLY, 0600)
+				pg, err := rpg.Preprocess(hostarch, buildarch, ctx.Bool("bootstrap"))
 				if err != nil {
-					return
-				}
-				var w io.WriteCloser
-				switch ext {
-				case ".tar":
-					w = tf
-				case ".gz":
-					w = gzip.NewWriter(tf)
+					return cli.NewExitError(err, 65)
 				}
-				defer func() {
-					cerr := w.Close()
-					if cerr != nil {
-						cerr = cli.NewExitError(cerr, 65)
-						if err == nil {
-							err = cerr
-						} else {
-							err = cli.NewMultiError(err, cerr)
-						}
-					}
-				}()
+				// check sources before writing anything
 				l, err := pkgen.MultiLoader(
 					pkgen.HTTPLoader(
 						http.DefaultClient,
@@ -290,6 +409,34 @@ func main() {
 				if err != nil {
 					return cli.NewExitError(err, 65)
 				}
+				err = checkSources(pg, l)
+				if err != nil {
+					return cli.NewExitError(err, 65)
+				}
+				// prep writer for tar
+				tf, err := os.OpenFile(ctx.String("tar"), os.O_CREATE|os.O_WRONLY, 0600)
+				if err != nil {
+					return cli.NewExitError(err, 65)
+				}
+				w, err := compress(tf)
+				if err != nil {
+					tf.Close()
+					return cli.NewExitError(err, 65)
+				}
+				defer func() {
+					cerr := w.Close()
+					if fcerr := tf.Close(); cerr == nil {
+						cerr = fcerr
+					}
+					if cerr != nil {
+						cerr = cli.NewExitError(cerr, 65)
+						if err == nil {
+							err = cerr
+						} else {
+							err = cli.NewMultiError(err, cerr)
+						}
+					}
+				}()
 				// generate tar
 				tw := tar.NewWriter(w)
 				err = pg.WriteSourceTar(cctx, "", tw, l, ctx.Int64("maxbuf"))
@@ -379,6 +526,7 @@ func main() {
 						makebin,
 						"-l",
 						strconv.FormatUint(uint64(ctx.Uint("j")), 10),
+						string(pkgen.DefaultVars.Jobs) + "=" + strconv.FormatUint(uint64(ctx.Uint("j")), 10),
 					},
 					os.Environ(),
 				)
@@ -391,3 +539,16 @@ func main() {
 		panic(err)
 	}
 }
+
+// archFlags parses the hostarch and buildarch flags.
+func archFlags(ctx *cli.Context) (hostarch pkgen.Arch, buildarch pkgen.Arch, err error) {
+	hostarch, err = pkgen.ParseArch(ctx.String("hostarch"))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid hostarch %q: %s", ctx.String("hostarch"), err.Error())
+	}
+	buildarch, err = pkgen.ParseArch(ctx.String("buildarch"))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid buildarch %q: %s", ctx.String("buildarch"), err.Error())
+	}
+	return hostarch, buildarch, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+// checkSources checks that the protocols of all sources are supported by the loader.
+// The returned error lists all unsupported sources.
+func checkSources(pg *pkgen.PackageGenerator, l pkgen.Loader) error {
+	protos, err := l.SupportedProtocols()
+	if err != nil {
+		return err
+	}
+	supported := map[string]bool{}
+	for _, p := range protos {
+		supported[p] = true
+	}
+	bad := []string{}
+	for _, s := range pg.Sources {
+		if !supported[s.Scheme] {
+			bad = append(bad, fmt.Sprintf("%q (protocol %q)", s.String(), s.Scheme))
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("unsupported sources: %s (supported protocols: %s)", strings.Join(bad, ", "), strings.Join(protos, ", "))
+	}
+	return nil
+}
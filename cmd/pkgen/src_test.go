@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"gitlab.com/panux/builder/pkgen"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+func TestCheckSources(t *testing.T) {
+	l, err := pkgen.MultiLoader(
+		pkgen.HTTPLoader(nil, 1024),
+		pkgen.FileLoader(mapfs.New(map[string]string{})),
+	)
+	if err != nil {
+		t.Fatalf("failed to create loader: %s", err.Error())
+	}
+	srcs := func(strs ...string) *pkgen.PackageGenerator {
+		pg := &pkgen.PackageGenerator{}
+		for _, s := range strs {
+			u, err := url.Parse(s)
+			if err != nil {
+				t.Fatalf("failed to parse url: %s", err.Error())
+			}
+			pg.Sources = append(pg.Sources, u)
+		}
+		return pg
+	}
+
+	err = checkSources(srcs("https://example.com/example.tar.gz", "file:///example.patch"), l)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+
+	err = checkSources(srcs(
+		"https://example.com/example.tar.gz",
+		"ftp://example.com/example.tar.gz",
+		"git://example.com/example.git",
+	), l)
+	if err == nil {
+		t.Fatal("expected error for unsupported sources")
+	}
+	for _, s := range []string{"ftp://example.com/example.tar.gz", "git://example.com/example.git"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected error to name %q: %s", s, err.Error())
+		}
+	}
+	if strings.Contains(err.Error(), "https://example.com") {
+		t.Errorf("error names a supported source: %s", err.Error())
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -16,6 +17,9 @@ import (
 )
 
 func main() {
+	force := flag.Bool("force", false, "rebuild all packages, ignoring the build cache")
+	jobs := flag.Int("j", 8, "number of parallel jobs used by make in each build")
+	flag.Parse()
 	dcli, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
 		panic(err)
@@ -39,7 +43,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	dirstore := build.DirStore("out")
+	dirstore := build.DirStore("out", build.DirStoreOptions{})
 	logger := buildlog.TextLogger(os.Stderr)
 	g, err := build.Graph(rpi, build.GraphOptions{
 		Options: build.Options{
@@ -54,12 +58,14 @@ func main() {
 					10*1024*1024,
 				),
 				10*1024*1024),
-			Ctx: ctx,
+			Ctx:  ctx,
+			Jobs: *jobs,
 		},
-		Cache:      build.DirJSONCache("cache"),
-		Logger:     logger,
-		Arch:       arch,
-		SourceTree: stree,
+		Cache:        build.DirJSONCache("cache"),
+		ForceRebuild: *force,
+		Logger:       logger,
+		Arch:         arch,
+		SourceTree:   stree,
 	})
 	if err != nil {
 		panic(err)
@@ -68,7 +74,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	args := os.Args[1:]
+	args := flag.Args()
 	if len(args) == 0 {
 		args = []string{"all"}
 	}
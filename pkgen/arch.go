@@ -2,6 +2,7 @@
 package pkgen
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"runtime"
@@ -9,6 +10,7 @@ import (
 
 // ArchSet is a set of supported Arch's.
 // A nil value indicates that all Arch's are supported.
+// The ArchAll member indicates that all supported Arch's are included.
 type ArchSet []Arch
 
 // Supports checks if the ArchSet supports arch.
@@ -20,10 +22,81 @@ func (a ArchSet) Supports(arch Arch) bool {
 		if v == arch {
 			return true
 		}
+		if v == ArchAll && arch.Supported() {
+			return true
+		}
 	}
 	return false
 }
 
+// Expand returns an ArchSet with the ArchAll wildcard expanded into the members of SupportedArch.
+// A nil ArchSet is expanded to SupportedArch.
+func (a ArchSet) Expand() ArchSet {
+	res := ArchSet{}
+	for _, v := range SupportedArch {
+		if a.Supports(v) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// parseArchSet parses an ArchSet from a list of strings.
+func parseArchSet(strs []string) (ArchSet, error) {
+	set := make(ArchSet, len(strs))
+	for i, v := range strs {
+		if Arch(v) == ArchAll {
+			set[i] = ArchAll
+			continue
+		}
+		err := set[i].UnmarshalText([]byte(v))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+// Each Arch is validated, and the ArchAll wildcard is preserved.
+func (a *ArchSet) UnmarshalJSON(dat []byte) error {
+	var strs []string
+	err := json.Unmarshal(dat, &strs)
+	if err != nil {
+		return err
+	}
+	if strs == nil {
+		*a = nil
+		return nil
+	}
+	set, err := parseArchSet(strs)
+	if err != nil {
+		return err
+	}
+	*a = set
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+// Each Arch is validated, and the ArchAll wildcard is preserved.
+func (a *ArchSet) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var strs []string
+	err := unmarshal(&strs)
+	if err != nil {
+		return err
+	}
+	if strs == nil {
+		*a = nil
+		return nil
+	}
+	set, err := parseArchSet(strs)
+	if err != nil {
+		return err
+	}
+	*a = set
+	return nil
+}
+
 // Arch is an architecture.
 type Arch string
 
@@ -56,6 +129,8 @@ func (a Arch) GoArch() string {
 		return "386"
 	case Archx86_64:
 		return "amd64"
+	case Archaarch64:
+		return "arm64"
 	default:
 		return a.String()
 	}
@@ -80,6 +155,7 @@ func (a Arch) Supported() bool {
 	switch a {
 	case Archx86:
 	case Archx86_64:
+	case Archaarch64:
 	default:
 		return false
 	}
@@ -88,24 +164,59 @@ func (a Arch) Supported() bool {
 
 // Arch constants.
 const (
-	Archx86_64 Arch = "x86_64"
-	Archx86    Arch = "x86"
+	Archx86_64  Arch = "x86_64"
+	Archx86     Arch = "x86"
+	Archaarch64 Arch = "aarch64"
+
+	// ArchAll is a wildcard used in an ArchSet to include all supported Arch's.
+	// It is not a valid Arch on its own.
+	ArchAll Arch = "all"
 )
 
 // ErrUnsupportedArch is an error for an architecture that is not recognized.
 var ErrUnsupportedArch = errors.New("unsupported arch")
 
-// GetHostArch returns the arch on the host system.
-func GetHostArch() (Arch, error) {
-	switch runtime.GOARCH {
-	case "amd64":
-		return Archx86_64, nil
-	case "i386":
-		return Archx86, nil
-	default:
+// archAliases is a table of alternate names for Arch's.
+var archAliases = map[string]Arch{
+	"amd64": Archx86_64,
+	"x64":   Archx86_64,
+	"386":   Archx86,
+	"i386":  Archx86,
+	"i486":  Archx86,
+	"i586":  Archx86,
+	"i686":  Archx86,
+	"arm64": Archaarch64,
+}
+
+// ParseArch parses an Arch from a string.
+// Aliases (e.g. "amd64" or "i686") are normalized to the canonical Arch.
+// If the Arch is not supported, ErrUnsupportedArch is returned.
+func ParseArch(str string) (Arch, error) {
+	a, ok := archAliases[str]
+	if !ok {
+		a = Arch(str)
+	}
+	if !a.Supported() {
 		return "", ErrUnsupportedArch
 	}
+	return a, nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+// The Arch is parsed with ParseArch.
+func (a *Arch) UnmarshalText(text []byte) error {
+	pa, err := ParseArch(string(text))
+	if err != nil {
+		return fmt.Errorf("%s %q", err.Error(), string(text))
+	}
+	*a = pa
+	return nil
+}
+
+// GetHostArch returns the arch on the host system.
+func GetHostArch() (Arch, error) {
+	return ParseArch(runtime.GOARCH)
 }
 
 // SupportedArch is the set of supported Arch.
-var SupportedArch = ArchSet{"x86_64", "x86"}
+var SupportedArch = ArchSet{"x86_64", "x86", "aarch64"}
@@ -0,0 +1,163 @@
+package pkgen
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestArchNames(t *testing.T) {
+	tbl := []struct {
+		arch      Arch
+		autotools string
+		goarch    string
+	}{
+		{Archx86_64, "x86_64", "amd64"},
+		{Archx86, "i386", "386"},
+		{Archaarch64, "aarch64", "arm64"},
+	}
+	for _, v := range tbl {
+		if !v.arch.Supported() {
+			t.Errorf("arch %q not supported", v.arch)
+		}
+		if !SupportedArch.Supports(v.arch) {
+			t.Errorf("arch %q missing from SupportedArch", v.arch)
+		}
+		if at := v.arch.AutoTools(); at != v.autotools {
+			t.Errorf("expected autotools name %q for %q but got %q", v.autotools, v.arch, at)
+		}
+		if ga := v.arch.GoArch(); ga != v.goarch {
+			t.Errorf("expected GoArch %q for %q but got %q", v.goarch, v.arch, ga)
+		}
+	}
+	if Arch("sparc").Supported() {
+		t.Error("unknown arch sparc marked as supported")
+	}
+}
+
+func TestParseArch(t *testing.T) {
+	for _, v := range []string{"x86_64", "x86", "aarch64"} {
+		a, err := ParseArch(v)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err.Error())
+			continue
+		}
+		if a.String() != v {
+			t.Errorf("expected %q but got %q", v, a)
+		}
+	}
+	for _, v := range []string{"", "sparc", "X86_64"} {
+		_, err := ParseArch(v)
+		if err != ErrUnsupportedArch {
+			t.Errorf("expected ErrUnsupportedArch for %q but got %v", v, err)
+		}
+	}
+}
+
+func TestArchUnmarshalText(t *testing.T) {
+	var set ArchSet
+	err := json.Unmarshal([]byte(`["x86_64","aarch64"]`), &set)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	} else if !reflect.DeepEqual(set, ArchSet{Archx86_64, Archaarch64}) {
+		t.Errorf("expected [x86_64 aarch64] but got %v", set)
+	}
+	for _, v := range []string{`["sparc"]`, `[""]`} {
+		if err := json.Unmarshal([]byte(v), &set); err == nil {
+			t.Errorf("failed to reject %s", v)
+		}
+	}
+}
+
+func TestArchSetWildcard(t *testing.T) {
+	tbl := []struct {
+		set  ArchSet
+		arch Arch
+		ok   bool
+	}{
+		{ArchSet{ArchAll}, Archx86_64, true},
+		{ArchSet{ArchAll}, Archaarch64, true},
+		{ArchSet{ArchAll}, Arch("sparc"), false},
+		{ArchSet{Archx86, ArchAll}, Archx86_64, true},
+		{ArchSet{Archx86}, Archx86_64, false},
+		{nil, Arch("sparc"), true},
+	}
+	for _, v := range tbl {
+		if ok := v.set.Supports(v.arch); ok != v.ok {
+			t.Errorf("expected %v.Supports(%q) to be %v", v.set, v.arch, v.ok)
+		}
+	}
+	if exp := (ArchSet{ArchAll}).Expand(); !reflect.DeepEqual(exp, SupportedArch) {
+		t.Errorf("expected %v but got %v", SupportedArch, exp)
+	}
+}
+
+func TestArchSetWildcardJSON(t *testing.T) {
+	var set ArchSet
+	err := json.Unmarshal([]byte(`["all","x86"]`), &set)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if !reflect.DeepEqual(set, ArchSet{ArchAll, Archx86}) {
+		t.Errorf("expected [all x86] but got %v", set)
+	}
+	dat, err := json.Marshal(set)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if string(dat) != `["all","x86"]` {
+		t.Errorf("expected wildcard to be preserved but got %s", string(dat))
+	}
+}
+
+func TestArchSetYAML(t *testing.T) {
+	rpg, err := UnmarshalPkgen(strings.NewReader("arch: [all, x86_64]\n"))
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if !reflect.DeepEqual(rpg.Arch, ArchSet{ArchAll, Archx86_64}) {
+		t.Errorf("expected [all x86_64] but got %v", rpg.Arch)
+	}
+	_, err = UnmarshalPkgen(strings.NewReader("arch: [sparc]\n"))
+	if err == nil {
+		t.Error("failed to reject unsupported arch")
+	}
+}
+
+func TestArchAliases(t *testing.T) {
+	tbl := map[string]Arch{
+		"x86_64":  Archx86_64,
+		"amd64":   Archx86_64,
+		"x64":     Archx86_64,
+		"x86":     Archx86,
+		"386":     Archx86,
+		"i386":    Archx86,
+		"i486":    Archx86,
+		"i586":    Archx86,
+		"i686":    Archx86,
+		"aarch64": Archaarch64,
+		"arm64":   Archaarch64,
+	}
+	for in, expect := range tbl {
+		a, err := ParseArch(in)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %s", in, err.Error())
+			continue
+		}
+		if a != expect {
+			t.Errorf("expected %q to normalize to %q but got %q", in, expect, a)
+		}
+	}
+
+	var set ArchSet
+	err := json.Unmarshal([]byte(`["amd64","i686"]`), &set)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	} else if !reflect.DeepEqual(set, ArchSet{Archx86_64, Archx86}) {
+		t.Errorf("expected [x86_64 x86] but got %v", set)
+	}
+}
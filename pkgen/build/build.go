@@ -2,6 +2,7 @@ package build
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"context"
 	"errors"
@@ -9,6 +10,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -71,6 +73,53 @@ type Options struct {
 	// Ctx is the context to use for the build.
 	// If nil, defaults to context.Background()
 	Ctx context.Context
+
+	// Memory is the memory limit of the build container in bytes.
+	// Optional - if 0, memory is unlimited.
+	Memory int64
+
+	// CPUs is the number of CPUs available to the build container.
+	// Optional - if 0, CPU usage is unlimited.
+	CPUs float64
+
+	// PidsLimit is the maximum number of processes in the build container.
+	// Optional - if 0, the number of processes is unlimited.
+	PidsLimit int64
+
+	// Jobs is the number of parallel jobs used by make in the build container.
+	// It is passed to the build script in the JOBS environment variable.
+	// Optional - defaults to 8.
+	Jobs int
+
+	// BuildScript is the script run in the container to build the package.
+	// It is run from /root/build/build.sh, alongside the Makefile and the src and deps directories.
+	// The script must produce pkgs.tar in its directory.
+	// Optional - if nil, the default build script is used.
+	BuildScript []byte
+}
+
+// hostConfig generates the docker HostConfig for the build container.
+// If no resource limits are set, hostConfig returns nil.
+func (o *Options) hostConfig() *container.HostConfig {
+	if o.Memory == 0 && o.CPUs == 0 && o.PidsLimit == 0 {
+		return nil
+	}
+	return &container.HostConfig{
+		Resources: container.Resources{
+			Memory:    o.Memory,
+			NanoCPUs:  int64(o.CPUs * 1e9),
+			PidsLimit: o.PidsLimit,
+		},
+	}
+}
+
+// env generates the environment of the build container.
+func (o *Options) env() []string {
+	jobs := o.Jobs
+	if jobs <= 0 {
+		jobs = 8
+	}
+	return []string{"JOBS=" + strconv.Itoa(jobs)}
 }
 
 func (o *Options) fix(pkg *pkgen.PackageGenerator) error {
@@ -140,9 +189,145 @@ if [ -e deps ]; then
 fi
 
 # run build
-make -j8 SRCTAR=src pkgs.tar
+make -j${JOBS:-8} JOBS=${JOBS:-8} SRCTAR=src pkgs.tar
 `)
 
+// writeBuildScript writes the build script into the build tar.
+func (o *Options) writeBuildScript(tw *tar.Writer) error {
+	script := o.BuildScript
+	if script == nil {
+		script = buildScript
+	}
+	err := tw.WriteHeader(&tar.Header{
+		Name: "build.sh",
+		Mode: 0744,
+		Size: int64(len(script)),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(script)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// containerInspector is the subset of the docker client used to verify images.
+type containerInspector interface {
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+}
+
+// ErrImageMismatch is an error indicating that the docker image does not match the pinned digest.
+var ErrImageMismatch = errors.New("docker image does not match pinned digest")
+
+// verifyImage checks that the image used by a container matches the pinned image digest.
+// Images which are not pinned with a digest ("sha256:...") are not verified.
+func verifyImage(ctx context.Context, ci containerInspector, containerID string, image string) error {
+	if !strings.HasPrefix(image, "sha256:") {
+		return nil
+	}
+	inspect, err := ci.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container: %s", err.Error())
+	}
+	if inspect.ContainerJSONBase == nil {
+		return fmt.Errorf("%s: container has no image", ErrImageMismatch.Error())
+	}
+	if inspect.Image != image {
+		return fmt.Errorf("%s: expected %s but found %s", ErrImageMismatch.Error(), image, inspect.Image)
+	}
+	return nil
+}
+
+// buildDepArch gets the arch of the build dependencies of a package.
+// Build dependencies run in the build container, so for a cross build they are needed for the host arch rather than the build arch.
+func buildDepArch(pkg *pkgen.PackageGenerator) pkgen.Arch {
+	if pkgen.IsCross(pkg.HostArch, pkg.BuildArch) {
+		return pkg.HostArch
+	}
+	return pkg.BuildArch
+}
+
+// errTarAborted is an error used to unblock the tar generator if the receiver stops reading.
+var errTarAborted = errors.New("tar stream aborted")
+
+// sendTar streams a tar archive generated by gen to send.
+// If gen fails, send will see the error instead of the end of the stream.
+// If send stops reading early, gen will fail to write, so neither side can leak.
+// If gen fails because send stopped reading, the error from send is returned.
+func sendTar(send func(io.Reader) error, gen func(*tar.Writer) error) error {
+	pr, pw := io.Pipe()
+	senderr := make(chan error, 1)
+	go func() {
+		err := send(pr)
+		pr.CloseWithError(errTarAborted)
+		senderr <- err
+	}()
+
+	// generate tar
+	tw := tar.NewWriter(pw)
+	err := gen(tw)
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		pw.CloseWithError(err)
+		serr := <-senderr
+		if serr != nil && (err == errTarAborted || err == io.ErrClosedPipe) {
+			// the receiver failed first - the generator just saw the aborted stream
+			return serr
+		}
+		return err
+	}
+	pw.Close()
+
+	return <-senderr
+}
+
+// logDrainTimeout is the maximum time to wait for remaining logs after the container exits.
+const logDrainTimeout = 5 * time.Second
+
+// waitContainer waits for a container to exit while its logs are being streamed.
+// If the container exits before the log stream ends, the remaining logs are given the drain timeout to arrive before closeLogs is called.
+// Returns the exit code of the container.
+func waitContainer(logdone <-chan error, waitch <-chan container.ContainerWaitOKBody, waiterr <-chan error, closeLogs func(), drain time.Duration) (int64, error) {
+	select {
+	case err := <-logdone:
+		// log stream ended first
+		if err != nil {
+			return 0, err
+		}
+		select {
+		case res := <-waitch:
+			return waitResult(res)
+		case err := <-waiterr:
+			return 0, err
+		}
+	case res := <-waitch:
+		// container exited first
+		select {
+		case <-logdone:
+		case <-time.After(drain):
+			closeLogs()
+			<-logdone
+		}
+		return waitResult(res)
+	case err := <-waiterr:
+		closeLogs()
+		<-logdone
+		return 0, err
+	}
+}
+
+// waitResult extracts the exit code from a ContainerWait result.
+func waitResult(res container.ContainerWaitOKBody) (int64, error) {
+	if res.Error != nil {
+		return 0, fmt.Errorf("failed to wait for container: %s", res.Error.Message)
+	}
+	return res.StatusCode, nil
+}
+
 // Build builds a package.
 func Build(pkg *pkgen.PackageGenerator, opts Options) (err error) {
 	// prepare build configuration
@@ -177,8 +362,9 @@ func Build(pkg *pkgen.PackageGenerator, opts Options) (err error) {
 		&container.Config{
 			Image: opts.DockerImage.Image,
 			Cmd:   []string{"/root/build/build.sh"},
+			Env:   opts.env(),
 		},
-		nil, nil, "",
+		opts.hostConfig(), nil, "",
 	)
 	if err != nil {
 		return err
@@ -188,13 +374,20 @@ func Build(pkg *pkgen.PackageGenerator, opts Options) (err error) {
 		rctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 		defer cancel()
 		cerr := opts.Docker.ContainerRemove(rctx, containerCreate.ID, types.ContainerRemoveOptions{
-			Force: true,
+			Force:         true,
+			RemoveVolumes: true,
 		})
 		if cerr != nil && err == nil {
 			err = cerr
 		}
 	}()
 
+	// verify image
+	err = verifyImage(opts.Ctx, opts.Docker, containerCreate.ID, opts.DockerImage.Image)
+	if err != nil {
+		return err
+	}
+
 	// prepare to create build inputs
 	err = opts.Log.Log(buildlog.Line{
 		Stream: buildlog.StreamBuild,
@@ -205,143 +398,100 @@ func Build(pkg *pkgen.PackageGenerator, opts Options) (err error) {
 	}
 
 	// stream content to docker
-	pr, pw := io.Pipe()
-	var wg sync.WaitGroup
-	wg.Add(1)
-	defer wg.Wait()
-	var dcerr error
-	go func() {
-		defer wg.Done()
-		defer pr.Close()
-		dcerr = opts.Docker.CopyToContainer(
+	err = sendTar(func(r io.Reader) error {
+		return opts.Docker.CopyToContainer(
 			opts.Ctx,
 			containerCreate.ID,
 			"/root/build/",
-			pr,
+			r,
 			types.CopyToContainerOptions{},
 		)
-	}()
-	defer pw.Close()
-
-	// generate tar data
-	tw := tar.NewWriter(pw)
-
-	// write source
-	err = tw.WriteHeader(&tar.Header{
-		Name:     "src",
-		Mode:     0644 | int64(os.ModeDir),
-		Typeflag: tar.TypeDir,
-	})
-	if err != nil {
-		return err
-	}
-	err = pkg.WriteSourceTar(opts.Ctx, "src", tw, opts.Loader, 0)
-	if err != nil {
-		return err
-	}
-
-	// symlink Makefile into base dir
-	err = tw.WriteHeader(&tar.Header{
-		Name:     "Makefile",
-		Mode:     0644 | int64(os.ModeSymlink),
-		Typeflag: tar.TypeSymlink,
-		Linkname: "src/Makefile",
-	})
-	if err != nil {
-		return err
-	}
+	}, func(tw *tar.Writer) error {
+		// write source
+		err := tw.WriteHeader(&tar.Header{
+			Name:     "src",
+			Mode:     0644 | int64(os.ModeDir),
+			Typeflag: tar.TypeDir,
+		})
+		if err != nil {
+			return err
+		}
+		err = pkg.WriteSourceTar(opts.Ctx, "src", tw, opts.Loader, 0)
+		if err != nil {
+			return err
+		}
 
-	// send dependencies
-	err = tw.WriteHeader(&tar.Header{
-		Name:     "deps",
-		Mode:     0644 | int64(os.ModeDir),
-		Typeflag: tar.TypeDir,
-	})
-	if err != nil {
-		return err
-	}
-	dlst := []string{}
-	deps, err := opts.Dependencies.FindDependencies(pkg.BuildDependencies...)
-	if err != nil {
-		return err
-	}
-dloop:
-	for _, v := range deps {
-		for _, p := range opts.DockerImage.Packages {
-			if v == p {
-				continue dloop
-			}
+		// symlink Makefile into base dir
+		err = tw.WriteHeader(&tar.Header{
+			Name:     "Makefile",
+			Mode:     0644 | int64(os.ModeSymlink),
+			Typeflag: tar.TypeSymlink,
+			Linkname: "src/Makefile",
+		})
+		if err != nil {
+			return err
 		}
 
-		rc, l, err := opts.Packages.GetPkg(v, pkg.BuildArch)
+		// send dependencies
+		err = tw.WriteHeader(&tar.Header{
+			Name:     "deps",
+			Mode:     0644 | int64(os.ModeDir),
+			Typeflag: tar.TypeDir,
+		})
 		if err != nil {
 			return err
 		}
+		dlst := []string{}
+		deps, err := opts.Dependencies.FindDependencies(pkg.BuildDependencies...)
+		if err != nil {
+			return err
+		}
+	dloop:
+		for _, v := range deps {
+			for _, p := range opts.DockerImage.Packages {
+				if v == p {
+					continue dloop
+				}
+			}
+
+			rc, l, err := opts.Packages.GetPkg(v, buildDepArch(pkg))
+			if err != nil {
+				return err
+			}
 
-		name := filepath.Join("deps", v+".tar.gz")
+			name := filepath.Join("deps", v+FormatGzip.Ext())
+			err = writeDep(tw, name, rc, l)
+			if err != nil {
+				return fmt.Errorf("package %q: %s", v, err.Error())
+			}
 
+			dlst = append(dlst, name)
+		}
+		dtxt := []byte(strings.Join(dlst, "\n"))
 		err = tw.WriteHeader(&tar.Header{
-			Name: name,
+			Name: "deps/deps.list",
 			Mode: 0644,
-			Size: l,
+			Size: int64(len(dtxt)),
 		})
 		if err != nil {
-			rc.Close()
 			return err
 		}
-
-		_, err = io.Copy(tw, rc)
-		cerr := rc.Close()
+		_, err = tw.Write(dtxt)
 		if err != nil {
 			return err
 		}
-		if cerr != nil {
+
+		// inject build script
+		err = opts.writeBuildScript(tw)
+		if err != nil {
 			return err
 		}
 
-		dlst = append(dlst, name)
-	}
-	dtxt := []byte(strings.Join(dlst, "\n"))
-	err = tw.WriteHeader(&tar.Header{
-		Name: "deps/deps.list",
-		Mode: 0644,
-		Size: int64(len(dtxt)),
+		return nil
 	})
 	if err != nil {
 		return err
 	}
-	_, err = tw.Write(dtxt)
-	if err != nil {
-		return err
-	}
-
-	// inject build script
-	err = tw.WriteHeader(&tar.Header{
-		Name: "build.sh",
-		Mode: 0744,
-		Size: int64(len(buildScript)),
-	})
-	if err != nil {
-		return err
-	}
-	_, err = tw.Write(buildScript)
-	if err != nil {
-		return err
-	}
-
-	// commit data to container filesystem
-	err = tw.Close()
-	if err != nil {
-		return err
-	}
-	err = pw.Close()
-	if err != nil {
-		return err
-	}
-	wg.Wait()
-	if dcerr != nil {
-		return dcerr
-	}
 
 	// start build
 	err = opts.Log.Log(buildlog.Line{
@@ -356,42 +506,46 @@ dloop:
 		return err
 	}
 
+	// watch for container exit
+	waitch, waiterr := opts.Docker.ContainerWait(opts.Ctx, containerCreate.ID, container.WaitConditionNotRunning)
+
 	// log build
 	lr, err := opts.Docker.ContainerLogs(opts.Ctx, containerCreate.ID, types.ContainerLogsOptions{
 		ShowStdout: true,
 		ShowStderr: true,
 		Follow:     true,
 	})
-	defer func() {
-		cerr := lr.Close()
-		if cerr != nil && err == nil {
-			err = cerr
-		}
-	}()
 	if err != nil {
 		return err
 	}
+	var lronce sync.Once
+	closeLogs := func() {
+		lronce.Do(func() {
+			cerr := lr.Close()
+			if cerr != nil && err == nil {
+				err = cerr
+			}
+		})
+	}
+	defer closeLogs()
 	opts.Log = buildlog.MutexedLogHandler(opts.Log)
 	sow := buildlog.LogWriter(opts.Log, buildlog.StreamStdout)
 	sew := buildlog.LogWriter(opts.Log, buildlog.StreamStderr)
 	defer sow.Close()
 	defer sew.Close()
-	_, err = stdcopy.StdCopy(sow, sew, lr)
-	if err != nil {
-		return err
-	}
+	logdone := make(chan error, 1)
+	go func() {
+		_, lerr := stdcopy.StdCopy(sow, sew, lr)
+		logdone <- lerr
+	}()
 
-	// check if completed ok
-	info, err := opts.Docker.ContainerInspect(opts.Ctx, containerCreate.ID)
+	// wait for build to complete
+	code, err := waitContainer(logdone, waitch, waiterr, closeLogs, logDrainTimeout)
 	if err != nil {
 		return err
 	}
-	state := info.ContainerJSONBase.State
-	if state.Running {
-		return errors.New("container still running")
-	}
-	if state.ExitCode != 0 {
-		return fmt.Errorf("build failed with exit code %d", state.ExitCode)
+	if code != 0 {
+		return fmt.Errorf("build failed with exit code %d", code)
 	}
 
 	err = opts.Log.Log(buildlog.Line{
@@ -413,28 +567,92 @@ dloop:
 	if err != nil {
 		return err
 	}
-	tr := tar.NewReader(otr)
+	err = storeOutputs(tar.NewReader(otr), opts.Output, pkg.BuildArch)
+	if err != nil {
+		return err
+	}
+	err = opts.Log.Log(buildlog.Line{
+		Stream: buildlog.StreamBuild,
+		Text:   "Build Complete!",
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeDep writes a dependency package of length n to the tar with the given name, and closes it.
+// The package installer only handles gzip, so packages in other formats are converted to gzip.
+func writeDep(tw *tar.Writer, name string, rc io.ReadCloser, n int64) (err error) {
+	defer func() {
+		cerr := rc.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	// detect package format
+	br := bufio.NewReader(rc)
+	format, err := detectFormat(br)
+	if err != nil {
+		return err
+	}
+	var body io.Reader = br
+	if format != FormatGzip {
+		// buffer the converted package, as the size is needed for the tar header
+		cr, err := convertFormat(br, FormatGzip)
+		if err != nil {
+			return err
+		}
+		defer cr.Close()
+		buf := new(bytes.Buffer)
+		_, err = io.Copy(buf, cr)
+		if err != nil {
+			return err
+		}
+		body, n = buf, int64(buf.Len())
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: n,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, body)
+	return err
+}
+
+// storeOutputs stores the packages from a build output tar.
+// Packages are converted to gzip format before being passed to the OutputHandler.
+func storeOutputs(tr *tar.Reader, out OutputHandler, arch pkgen.Arch) error {
 	for {
 		hdr, err := tr.Next()
 		if err != nil {
 			if err == io.EOF {
-				err = opts.Log.Log(buildlog.Line{
-					Stream: buildlog.StreamBuild,
-					Text:   "Build Complete!",
-				})
-				if err != nil {
-					return err
-				}
 				return nil
 			}
 			return err
 		}
-		spl := strings.Split(filepath.Base(hdr.Name), ".")
-		if len(spl) < 2 {
+		format, err := FormatFromName(hdr.Name)
+		if err != nil {
 			return fmt.Errorf("found invalid output file %q", hdr.Name)
 		}
-		pkname := spl[0]
-		err = opts.Output.Store(pkname, pkg.BuildArch, tr)
+		pkname := strings.Split(filepath.Base(hdr.Name), ".")[0]
+		err = func() error {
+			var body io.Reader = tr
+			if format != FormatGzip {
+				rc, err := convertFormat(tr, FormatGzip)
+				if err != nil {
+					return err
+				}
+				defer rc.Close()
+				body = rc
+			}
+			return out.Store(pkname, arch, body)
+		}()
 		if err != nil {
 			return err
 		}
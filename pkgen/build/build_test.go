@@ -0,0 +1,371 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"gitlab.com/panux/builder/pkgen"
+)
+
+func TestHostConfig(t *testing.T) {
+	if hc := (&Options{}).hostConfig(); hc != nil {
+		t.Errorf("expected no HostConfig without limits but got %+v", hc)
+	}
+	hc := (&Options{
+		Memory:    512 * 1024 * 1024,
+		CPUs:      1.5,
+		PidsLimit: 100,
+	}).hostConfig()
+	if hc == nil {
+		t.Fatal("missing HostConfig")
+	}
+	if hc.Memory != 512*1024*1024 {
+		t.Errorf("expected memory limit %d but got %d", 512*1024*1024, hc.Memory)
+	}
+	if hc.NanoCPUs != 1500000000 {
+		t.Errorf("expected CPU limit %d but got %d", 1500000000, hc.NanoCPUs)
+	}
+	if hc.PidsLimit != 100 {
+		t.Errorf("expected pids limit %d but got %d", 100, hc.PidsLimit)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	tbl := []struct {
+		jobs int
+		env  []string
+	}{
+		{0, []string{"JOBS=8"}},
+		{3, []string{"JOBS=3"}},
+	}
+	for _, v := range tbl {
+		env := (&Options{Jobs: v.jobs}).env()
+		if !reflect.DeepEqual(env, v.env) {
+			t.Errorf("expected %q but got %q", v.env, env)
+		}
+	}
+	if !bytes.Contains(buildScript, []byte("make -j${JOBS:-8} JOBS=${JOBS:-8}")) {
+		t.Errorf("build script does not use JOBS:\n%s", buildScript)
+	}
+}
+
+func TestStoreOutputs(t *testing.T) {
+	// generate output tar
+	pkgs := map[string]PackageFormat{
+		"example.tar.xz":      FormatXZ,
+		"example-dev.tar.gz":  FormatGzip,
+		"example-doc.tar.zst": FormatZstd,
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, f := range pkgs {
+		var pbuf bytes.Buffer
+		w, err := f.writer(&pbuf)
+		if err != nil {
+			t.Fatalf("failed to create writer: %s", err.Error())
+		}
+		_, err = w.Write([]byte(name))
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			t.Fatalf("failed to compress: %s", err.Error())
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name: "./" + name,
+			Mode: 0644,
+			Size: int64(pbuf.Len()),
+		})
+		if err == nil {
+			_, err = tw.Write(pbuf.Bytes())
+		}
+		if err != nil {
+			t.Fatalf("failed to write tar: %s", err.Error())
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatalf("failed to write tar: %s", err.Error())
+	}
+
+	// store and read back outputs
+	dir, err := ioutil.TempDir("", "outputs")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	for _, ps := range []PackageStore{MemStore(), DirStore(dir, DirStoreOptions{})} {
+		err = storeOutputs(tar.NewReader(bytes.NewReader(buf.Bytes())), ps, pkgen.Archx86_64)
+		if err != nil {
+			t.Fatalf("failed to store outputs: %s", err.Error())
+		}
+		for name := range pkgs {
+			rc, _, err := ps.GetPkg(strings.Split(name, ".")[0], pkgen.Archx86_64)
+			if err != nil {
+				t.Fatalf("failed to get %q: %s", name, err.Error())
+			}
+			gr, err := gzip.NewReader(rc)
+			if err != nil {
+				t.Fatalf("%q is not stored as gzip: %s", name, err.Error())
+			}
+			dat, err := ioutil.ReadAll(gr)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("failed to read %q: %s", name, err.Error())
+			}
+			if string(dat) != name {
+				t.Errorf("expected %q but got %q", name, dat)
+			}
+		}
+	}
+}
+
+func TestWriteDep(t *testing.T) {
+	for _, f := range packageFormats {
+		t.Run(f.String(), func(t *testing.T) {
+			var pbuf bytes.Buffer
+			w, err := f.writer(&pbuf)
+			if err != nil {
+				t.Fatalf("failed to create writer: %s", err.Error())
+			}
+			_, err = w.Write([]byte("dependency"))
+			if err == nil {
+				err = w.Close()
+			}
+			if err != nil {
+				t.Fatalf("failed to compress: %s", err.Error())
+			}
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			err = writeDep(tw, "deps/example.tar.gz", ioutil.NopCloser(&pbuf), int64(pbuf.Len()))
+			if err != nil {
+				t.Fatalf("failed to write dependency: %s", err.Error())
+			}
+			err = tw.Close()
+			if err != nil {
+				t.Fatalf("failed to write tar: %s", err.Error())
+			}
+
+			tr := tar.NewReader(&buf)
+			hdr, err := tr.Next()
+			if err != nil {
+				t.Fatalf("failed to read tar: %s", err.Error())
+			}
+			if hdr.Name != "deps/example.tar.gz" {
+				t.Errorf("unexpected name %q", hdr.Name)
+			}
+			gr, err := gzip.NewReader(tr)
+			if err != nil {
+				t.Fatalf("dependency is not gzip: %s", err.Error())
+			}
+			dat, err := ioutil.ReadAll(gr)
+			if err != nil {
+				t.Fatalf("failed to read dependency: %s", err.Error())
+			}
+			if string(dat) != "dependency" {
+				t.Errorf("expected %q but got %q", "dependency", dat)
+			}
+		})
+	}
+}
+
+func TestWriteBuildScript(t *testing.T) {
+	custom := []byte("#!/bin/sh\nchroot /root/build make pkgs.tar\n")
+	tbl := []struct {
+		opts   Options
+		script []byte
+	}{
+		{Options{}, buildScript},
+		{Options{BuildScript: custom}, custom},
+	}
+	for _, v := range tbl {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		err := v.opts.writeBuildScript(tw)
+		if err != nil {
+			t.Fatalf("failed to write build script: %s", err.Error())
+		}
+		err = tw.Close()
+		if err != nil {
+			t.Fatalf("failed to close tar: %s", err.Error())
+		}
+		tr := tar.NewReader(&buf)
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("failed to read tar: %s", err.Error())
+		}
+		if hdr.Name != "build.sh" {
+			t.Errorf("expected build.sh but got %q", hdr.Name)
+		}
+		dat, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("failed to read tar: %s", err.Error())
+		}
+		if !bytes.Equal(dat, v.script) {
+			t.Errorf("expected script %q but got %q", string(v.script), string(dat))
+		}
+	}
+}
+
+func TestWaitContainerFastFail(t *testing.T) {
+	logdone := make(chan error, 1)
+	waitch := make(chan container.ContainerWaitOKBody, 1)
+	waiterr := make(chan error)
+	closed := false
+	closeLogs := func() {
+		// tearing down the log stream ends the log copy
+		closed = true
+		logdone <- io.ErrClosedPipe
+	}
+
+	// container exits immediately while the log stream stays open
+	waitch <- container.ContainerWaitOKBody{StatusCode: 1}
+	done := make(chan struct{})
+	var code int64
+	var err error
+	go func() {
+		defer close(done)
+		code, err = waitContainer(logdone, waitch, waiterr, closeLogs, 10*time.Millisecond)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("exit was not reported promptly")
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if code != 1 {
+		t.Errorf("expected exit code 1 but got %d", code)
+	}
+	if !closed {
+		t.Error("log stream was not closed")
+	}
+}
+
+func TestWaitContainerLogsFirst(t *testing.T) {
+	logdone := make(chan error, 1)
+	waitch := make(chan container.ContainerWaitOKBody, 1)
+	logdone <- nil
+	waitch <- container.ContainerWaitOKBody{StatusCode: 0}
+	code, err := waitContainer(logdone, waitch, make(chan error), func() {
+		t.Error("log stream closed after completion")
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if code != 0 {
+		t.Errorf("expected exit code 0 but got %d", code)
+	}
+}
+
+// fakeContainerInspector is a containerInspector with a fixed set of containers, mapped to their resolved images.
+type fakeContainerInspector map[string]string
+
+func (fci fakeContainerInspector) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	img, ok := fci[containerID]
+	if !ok {
+		return types.ContainerJSON{}, errors.New("no such container")
+	}
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    containerID,
+			Image: img,
+		},
+	}, nil
+}
+
+func TestVerifyImage(t *testing.T) {
+	pinned := "sha256:" + strings.Repeat("a", 64)
+	other := "sha256:" + strings.Repeat("b", 64)
+	ci := fakeContainerInspector{
+		"good": pinned,
+		"bad":  other,
+	}
+	err := verifyImage(context.Background(), ci, "good", pinned)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	err = verifyImage(context.Background(), ci, "bad", pinned)
+	if err == nil || !strings.HasPrefix(err.Error(), ErrImageMismatch.Error()) {
+		t.Errorf("expected image mismatch error but got %v", err)
+	}
+	err = verifyImage(context.Background(), ci, "missing", pinned)
+	if err == nil {
+		t.Error("expected error for missing container")
+	}
+
+	// unpinned images are not verified
+	err = verifyImage(context.Background(), ci, "bad", "panux/builder:latest")
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+}
+
+func TestSendTarEarlyFailure(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	// receiver fails without reading
+	recvErr := errors.New("receiver failed")
+	err := sendTar(func(r io.Reader) error {
+		return recvErr
+	}, func(tw *tar.Writer) error {
+		dat := make([]byte, 1024*1024)
+		err := tw.WriteHeader(&tar.Header{
+			Name: "big",
+			Mode: 0644,
+			Size: int64(len(dat)),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(dat)
+		return err
+	})
+	if err != recvErr {
+		t.Errorf("expected receiver error but got %v", err)
+	}
+
+	// generator fails
+	genErr := errors.New("generator failed")
+	var recvd error
+	err = sendTar(func(r io.Reader) error {
+		_, recvd = io.Copy(ioutil.Discard, r)
+		if recvd != nil {
+			// the receiver reports its own (secondary) error, like CopyToContainer
+			return fmt.Errorf("failed to copy: %s", recvd.Error())
+		}
+		return nil
+	}, func(tw *tar.Writer) error {
+		return genErr
+	})
+	if err != genErr {
+		t.Errorf("expected generator error but got %v", err)
+	}
+	if recvd != genErr {
+		t.Errorf("expected receiver to see generator error but got %v", recvd)
+	}
+
+	// check for leaked goroutines
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("leaked %d goroutines", n-before)
+	}
+}
@@ -6,18 +6,25 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"gitlab.com/panux/builder/pkgen"
 )
 
-// HashCache is a cache of hashes
+// HashCache is a cache of hashes.
+// A HashCache is safe for concurrent use.
 type HashCache struct {
+	// lck is a lock guarding m and scan
+	lck sync.Mutex
+
 	// m is a map of hashCacheKey to hashCacheEntries
 	m map[hashCacheKey]*hashCacheEntry
 
@@ -32,6 +39,9 @@ type HashCache struct {
 // Any cache entries not used since the last call to Clean will be deleted.
 // In addition, all entries will be timestamp-validated on their next use.
 func (hc *HashCache) Clean() {
+	hc.lck.Lock()
+	defer hc.lck.Unlock()
+
 	// clean old entries
 	for k, v := range hc.m {
 		if v.scan != hc.scan {
@@ -66,31 +76,57 @@ type hashCacheEntry struct {
 	timestamp time.Time
 }
 
+// NewHashCache creates a new HashCache which hashes packages from the given PackageRetriever.
+func NewHashCache(pr PackageRetriever) *HashCache {
+	return &HashCache{
+		m:  map[hashCacheKey]*hashCacheEntry{},
+		pr: pr,
+	}
+}
+
 // PackageHash hashes the corresponding package file.
 // Cache entries will not be revalidated until the next call to Clean.
 // After a call to Clean, a cache entry may be revalidated via timestamp.
 // Timestamp caching is only available if the PackageRetriever returns a *os.File.
-func (hc *HashCache) PackageHash(name string, arch pkgen.Arch) (hash [sha256.Size]byte, err error) {
+// If the context is cancelled while hashing, the context error is returned.
+func (hc *HashCache) PackageHash(ctx context.Context, name string, arch pkgen.Arch) (hash [sha256.Size]byte, err error) {
 	hck := hashCacheKey{
 		name: name,
 		arch: arch,
 	}
 
 	// lookup in cache
+	hc.lck.Lock()
+	var prev hashCacheEntry
 	hce := hc.m[hck]
-	if hce != nil && hce.scan == hc.scan {
-		return hce.hash, nil
-	}
-	if hce == nil {
-		hce = new(hashCacheEntry)
-		hc.m[hck] = hce
+	if hce != nil {
+		if hce.scan == hc.scan {
+			hc.lck.Unlock()
+			return hce.hash, nil
+		}
+		prev = *hce
 	}
-	hce.scan = hc.scan
+	scan := hc.scan
+	hc.lck.Unlock()
 
+	// the lock is not held while hashing, so the cache is updated afterwards
+	var timestamp time.Time
 	defer func() {
-		// flush cache entry on error
+		hc.lck.Lock()
+		defer hc.lck.Unlock()
 		if err != nil {
+			// flush cache entry on error
 			delete(hc.m, hck)
+			return
+		}
+		if scan != hc.scan {
+			// cache was cleaned while hashing
+			return
+		}
+		hc.m[hck] = &hashCacheEntry{
+			hash:      hash,
+			scan:      scan,
+			timestamp: timestamp,
 		}
 	}()
 
@@ -114,33 +150,105 @@ func (hc *HashCache) PackageHash(name string, arch pkgen.Arch) (hash [sha256.Siz
 		if err != nil {
 			return [sha256.Size]byte{}, err
 		}
-		t := inf.ModTime()
-		if t.Equal(hce.timestamp) {
-			return hce.hash, nil
+		timestamp = inf.ModTime()
+		if hce != nil && timestamp.Equal(prev.timestamp) {
+			return prev.hash, nil
 		}
-		hce.timestamp = t
 	}
 
 	// hash package
 	h := sha256.New()
-	_, err = io.Copy(h, r)
+	err = copyCtx(ctx, h, r)
 	if err != nil {
 		return [sha256.Size]byte{}, err
 	}
+	h.Sum(hash[:0])
+
+	return hash, nil
+}
 
-	// store to cache
-	h.Sum(hce.hash[:0])
+// ctxReader is an io.Reader which stops reading when the context is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
 
-	return hce.hash, nil
+func (cr ctxReader) Read(dat []byte) (int, error) {
+	err := cr.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return cr.r.Read(dat)
 }
 
-type hashRow struct {
-	URL  string            `json:"url"`
+// copyCtx copies from r to w until the context is cancelled.
+// If a Read is blocked when the context is cancelled, r is closed to unblock it, and the context error is returned.
+func copyCtx(ctx context.Context, w io.Writer, r io.ReadCloser) error {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			r.Close()
+		case <-done:
+		}
+	}()
+	_, err := io.Copy(w, ctxReader{ctx: ctx, r: r})
+	close(done)
+	wg.Wait()
+	if cerr := ctx.Err(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// InputHash is the hash of an input to a build.
+type InputHash struct {
+	// URL identifies the input.
+	URL string `json:"url"`
+
+	// Hash is the SHA256 hash of the input.
+	// Inputs identified only by URL have a zero hash.
 	Hash [sha256.Size]byte `json:"hash"`
 }
 
+// RebuildReasons compares the inputs of a cached build to the inputs of a new build.
+// It returns a list of reasons explaining why the package must be rebuilt.
+// Each reason is a message containing the URL of a changed input.
+func RebuildReasons(cached Info, info Info) []string {
+	if cached.Hash == info.Hash {
+		return nil
+	}
+	if cached.Inputs == nil {
+		return []string{"cached build has no recorded inputs"}
+	}
+	old := make(map[string][sha256.Size]byte, len(cached.Inputs))
+	for _, v := range cached.Inputs {
+		old[v.URL] = v.Hash
+	}
+	reasons := []string{}
+	for _, v := range info.Inputs {
+		h, ok := old[v.URL]
+		switch {
+		case !ok:
+			reasons = append(reasons, fmt.Sprintf("%s added", v.URL))
+		case h != v.Hash:
+			reasons = append(reasons, fmt.Sprintf("%s changed", v.URL))
+		}
+		delete(old, v.URL)
+	}
+	for _, v := range cached.Inputs {
+		if _, ok := old[v.URL]; ok {
+			reasons = append(reasons, fmt.Sprintf("%s removed", v.URL))
+		}
+	}
+	return reasons
+}
+
 // hashSource hashes a source
-func hashSource(ctx context.Context, url *url.URL, loader pkgen.Loader) (row hashRow, err error) {
+func hashSource(ctx context.Context, url *url.URL, loader pkgen.Loader) (row InputHash, err error) {
 	// create context with scoped cancellation
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -148,7 +256,7 @@ func hashSource(ctx context.Context, url *url.URL, loader pkgen.Loader) (row has
 	// get source
 	_, r, err := loader.Get(ctx, url)
 	if err != nil {
-		return hashRow{}, err
+		return InputHash{}, err
 	}
 	defer func() {
 		cerr := r.Close()
@@ -159,9 +267,9 @@ func hashSource(ctx context.Context, url *url.URL, loader pkgen.Loader) (row has
 
 	// hash source
 	h := sha256.New()
-	_, err = io.Copy(h, r)
+	err = copyCtx(ctx, h, r)
 	if err != nil {
-		return hashRow{}, err
+		return InputHash{}, err
 	}
 
 	// generate row
@@ -183,16 +291,23 @@ func hashObjectJSON(obj interface{}, dest *[sha256.Size]byte) error {
 }
 
 // HashPackage hashes the inputs of a package.
-func HashPackage(ctx context.Context, pkg *pkgen.PackageGenerator, loader pkgen.Loader, hc *HashCache, docker Image, deps DependencyFinder) (hashhh [sha256.Size]byte, err error) {
+func HashPackage(ctx context.Context, pkg *pkgen.PackageGenerator, loader pkgen.Loader, hc *HashCache, docker Image, deps DependencyFinder) ([sha256.Size]byte, error) {
+	hash, _, err := HashPackageInputs(ctx, pkg, loader, hc, docker, deps)
+	return hash, err
+}
+
+// HashPackageInputs hashes the inputs of a package.
+// In addition to the overall hash, the hashes of the individual inputs are returned.
+func HashPackageInputs(ctx context.Context, pkg *pkgen.PackageGenerator, loader pkgen.Loader, hc *HashCache, docker Image, deps DependencyFinder) (hash [sha256.Size]byte, inputs []InputHash, err error) {
 	// hash pkgen
-	tbl := []hashRow{
-		hashRow{
+	tbl := []InputHash{
+		{
 			URL: "meta://pkgen.json",
 		},
 	}
 	err = hashObjectJSON(pkg, &tbl[0].Hash)
 	if err != nil {
-		return [sha256.Size]byte{}, err
+		return [sha256.Size]byte{}, nil, err
 	}
 
 	// add sources to table
@@ -201,19 +316,19 @@ func HashPackage(ctx context.Context, pkg *pkgen.PackageGenerator, loader pkgen.
 			// hash files
 			row, err := hashSource(ctx, s, loader)
 			if err != nil {
-				return [sha256.Size]byte{}, err
+				return [sha256.Size]byte{}, nil, err
 			}
 			tbl = append(tbl, row)
 		} else {
 			// just put the URL for non-file sources
-			tbl = append(tbl, hashRow{URL: s.String()})
+			tbl = append(tbl, InputHash{URL: s.String()})
 		}
 	}
 
 	// find build dependencies
 	dlst, err := deps.FindDependencies(pkg.BuildDependencies...)
 	if err != nil {
-		return [sha256.Size]byte{}, err
+		return [sha256.Size]byte{}, nil, err
 	}
 dloop:
 	for _, d := range dlst {
@@ -225,30 +340,30 @@ dloop:
 		}
 
 		// get package hash
-		hash, err := hc.PackageHash(d, pkg.BuildArch)
+		hash, err := hc.PackageHash(ctx, d, buildDepArch(pkg))
 		if err != nil {
-			return [sha256.Size]byte{}, err
+			return [sha256.Size]byte{}, nil, err
 		}
 
 		// add package to table
-		tbl = append(tbl, hashRow{
-			URL:  "package://" + d + "/" + pkg.BuildArch.String(),
+		tbl = append(tbl, InputHash{
+			URL:  "package://" + d + "/" + buildDepArch(pkg).String(),
 			Hash: hash,
 		})
 	}
 
 	// add docker image to container
 	if !strings.HasPrefix(docker.Image, "sha256:") {
-		return [sha256.Size]byte{}, errors.New("docker image identifier is not in hash format")
+		return [sha256.Size]byte{}, nil, errors.New("docker image identifier is not in hash format")
 	}
 	dhash, err := hex.DecodeString(strings.TrimPrefix(docker.Image, "sha256:"))
 	if err != nil {
-		return [sha256.Size]byte{}, err
+		return [sha256.Size]byte{}, nil, err
 	}
 	if len(dhash) != sha256.Size {
-		return [sha256.Size]byte{}, errors.New("malformed docker image identifier")
+		return [sha256.Size]byte{}, nil, errors.New("malformed docker image identifier")
 	}
-	var drow hashRow
+	var drow InputHash
 	copy(drow.Hash[:], dhash)
 	drow.URL = "docker://" + strings.TrimPrefix(docker.Image, "sha256:")
 	tbl = append(tbl, drow)
@@ -257,10 +372,10 @@ dloop:
 	var th [sha256.Size]byte
 	err = hashObjectJSON(tbl, &th)
 	if err != nil {
-		return [sha256.Size]byte{}, err
+		return [sha256.Size]byte{}, nil, err
 	}
 
-	return th, nil
+	return th, tbl, nil
 }
 
 // BuildCache is an interface used to cache builds.
@@ -272,29 +387,88 @@ type BuildCache interface {
 	Update(Info) error
 }
 
+// InfoLookup is an optional interface which may be implemented by a BuildCache.
+// It is used to find the reasons for a rebuild.
+type InfoLookup interface {
+	// Lookup gets the cached build Info for a package.
+	// The bool is false if there is no cache entry.
+	Lookup(name string, arch pkgen.Arch) (Info, bool, error)
+}
+
 type dirJSONCache struct {
 	dir string
 }
 
-func (jc dirJSONCache) Valid(info Info) (ok bool, err error) {
-	f, err := os.Open(filepath.Join(jc.dir, info.PackageName+"-"+info.Arch.String()+".json"))
+// jsonCacheEntry is the format of a file in a dirJSONCache.
+type jsonCacheEntry struct {
+	// Info is the JSON-encoded build Info.
+	Info json.RawMessage `json:"info"`
+
+	// Sum is the hex SHA256 hash of Info, used to detect corruption.
+	Sum string `json:"sum"`
+}
+
+// encodeCacheEntry encodes build Info into a checksummed cache entry.
+func encodeCacheEntry(info Info) ([]byte, error) {
+	dat, err := json.Marshal(info)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
-		}
-		return false, err
+		return nil, err
 	}
-	defer func() {
-		cerr := f.Close()
-		if cerr != nil && err == nil {
-			err = cerr
-			ok = false
+	sum := sha256.Sum256(dat)
+	return json.Marshal(jsonCacheEntry{
+		Info: dat,
+		Sum:  hex.EncodeToString(sum[:]),
+	})
+}
+
+// decodeCacheEntry decodes a checksummed cache entry.
+// Legacy entries (plain JSON-encoded Info without a checksum) are accepted, and are replaced with checksummed entries on the next Update.
+// If the entry is corrupt, the bool is false.
+func decodeCacheEntry(dat []byte) (Info, bool) {
+	var ent jsonCacheEntry
+	err := json.Unmarshal(dat, &ent)
+	if err != nil {
+		return Info{}, false
+	}
+	if ent.Info == nil && ent.Sum == "" {
+		// legacy entry
+		var info Info
+		err = json.Unmarshal(dat, &info)
+		if err != nil || info.PackageName == "" {
+			return Info{}, false
 		}
-	}()
+		return info, true
+	}
+	sum := sha256.Sum256(ent.Info)
+	if ent.Sum != hex.EncodeToString(sum[:]) {
+		return Info{}, false
+	}
+	var info Info
+	err = json.Unmarshal(ent.Info, &info)
+	if err != nil {
+		return Info{}, false
+	}
+	return info, true
+}
 
-	var cinfo Info
-	err = json.NewDecoder(f).Decode(&cinfo)
+// Lookup gets a cache entry.
+// Corrupt cache entries are treated as missing, and will be replaced by the next Update.
+func (jc dirJSONCache) Lookup(name string, arch pkgen.Arch) (Info, bool, error) {
+	dat, err := ioutil.ReadFile(filepath.Join(jc.dir, name+"-"+arch.String()+".json"))
 	if err != nil {
+		if os.IsNotExist(err) {
+			return Info{}, false, nil
+		}
+		return Info{}, false, err
+	}
+
+	info, ok := decodeCacheEntry(dat)
+	return info, ok, nil
+}
+
+func (jc dirJSONCache) Valid(info Info) (bool, error) {
+	cinfo, ok, err := jc.Lookup(info.PackageName, info.Arch)
+	if err != nil || !ok {
 		return false, err
 	}
 
@@ -302,6 +476,11 @@ func (jc dirJSONCache) Valid(info Info) (ok bool, err error) {
 }
 
 func (jc dirJSONCache) Update(info Info) (err error) {
+	dat, err := encodeCacheEntry(info)
+	if err != nil {
+		return err
+	}
+
 	f, err := os.OpenFile(filepath.Join(jc.dir, info.PackageName+"-"+info.Arch.String()+".json"), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
 	if err != nil {
 		return err
@@ -313,15 +492,97 @@ func (jc dirJSONCache) Update(info Info) (err error) {
 		}
 	}()
 
-	err = json.NewEncoder(f).Encode(info)
+	_, err = f.Write(dat)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (jc dirJSONCache) LoadAll() (BuildCache, error) {
+	pc := &prefetchedCache{
+		BuildCache: jc,
+		entries:    map[string]Info{},
+	}
+
+	// list cache files
+	files, err := ioutil.ReadDir(jc.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pc, nil
+		}
+		return nil, err
+	}
+
+	// load cache entries
+	for _, v := range files {
+		if v.IsDir() || !strings.HasSuffix(v.Name(), ".json") {
+			continue
+		}
+		dat, err := ioutil.ReadFile(filepath.Join(jc.dir, v.Name()))
+		if err != nil {
+			return nil, err
+		}
+		info, ok := decodeCacheEntry(dat)
+		if !ok {
+			// corrupt entry - rebuild
+			continue
+		}
+		pc.entries[strings.TrimSuffix(v.Name(), ".json")] = info
+	}
+
+	return pc, nil
+}
+
+// BatchValidator is an optional interface which may be implemented by a BuildCache.
+// It is used by Graph to avoid loading cache entries individually.
+type BatchValidator interface {
+	// LoadAll loads all cache entries into memory.
+	// The returned BuildCache validates against the loaded entries, and passes updates through to the underlying cache.
+	LoadAll() (BuildCache, error)
+}
+
+// prefetchedCache is a BuildCache with entries loaded into memory.
+type prefetchedCache struct {
+	// BuildCache is the underlying BuildCache
+	BuildCache
+
+	lck     sync.Mutex
+	entries map[string]Info
+}
+
+func (pc *prefetchedCache) Valid(info Info) (bool, error) {
+	pc.lck.Lock()
+	defer pc.lck.Unlock()
+
+	cinfo, ok := pc.entries[info.PackageName+"-"+info.Arch.String()]
+	return ok && cinfo.Hash == info.Hash, nil
+}
+
+func (pc *prefetchedCache) Update(info Info) error {
+	err := pc.BuildCache.Update(info)
 	if err != nil {
 		return err
 	}
 
+	pc.lck.Lock()
+	defer pc.lck.Unlock()
+	pc.entries[info.PackageName+"-"+info.Arch.String()] = info
+
 	return nil
 }
 
+func (pc *prefetchedCache) Lookup(name string, arch pkgen.Arch) (Info, bool, error) {
+	pc.lck.Lock()
+	defer pc.lck.Unlock()
+
+	info, ok := pc.entries[name+"-"+arch.String()]
+	return info, ok, nil
+}
+
 // DirJSONCache creates a BuildCache storing JSON blobs in the dir.
+// Each blob contains a checksum, and corrupt blobs are treated as missing entries.
 func DirJSONCache(dir string) BuildCache {
 	return dirJSONCache{dir: dir}
 }
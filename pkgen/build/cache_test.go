@@ -0,0 +1,340 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/panux/builder/pkgen"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+func TestHashCacheConcurrent(t *testing.T) {
+	ms := MemStore()
+	for i := 0; i < 8; i++ {
+		err := ms.Store(fmt.Sprintf("pkg%d", i), pkgen.Archx86_64, strings.NewReader(fmt.Sprintf("package %d", i)))
+		if err != nil {
+			t.Fatalf("failed to store package: %s", err.Error())
+		}
+	}
+	hc := NewHashCache(ms)
+
+	expect := make([][32]byte, 8)
+	for i := range expect {
+		h, err := hc.PackageHash(context.Background(), fmt.Sprintf("pkg%d", i), pkgen.Archx86_64)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		expect[i] = h
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%16 == 0 {
+				hc.Clean()
+			}
+			n := i % 8
+			h, err := hc.PackageHash(context.Background(), fmt.Sprintf("pkg%d", n), pkgen.Archx86_64)
+			if err != nil {
+				t.Errorf("unexpected error: %s", err.Error())
+				return
+			}
+			if h != expect[n] {
+				t.Errorf("wrong hash for pkg%d", n)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// endlessRetriever is a PackageRetriever serving endless packages.
+type endlessRetriever struct{}
+
+func (endlessRetriever) GetPkg(name string, arch pkgen.Arch) (io.ReadCloser, int64, error) {
+	return ioutil.NopCloser(endlessReader{}), -1, nil
+}
+
+type endlessReader struct{}
+
+func (endlessReader) Read(dat []byte) (int, error) {
+	return len(dat), nil
+}
+
+func TestHashCacheCancel(t *testing.T) {
+	hc := NewHashCache(endlessRetriever{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	errch := make(chan error, 1)
+	go func() {
+		_, err := hc.PackageHash(ctx, "example", pkgen.Archx86_64)
+		errch <- err
+	}()
+	select {
+	case err := <-errch:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hash was not cancelled")
+	}
+}
+
+// blockingRetriever is a PackageRetriever serving packages which block until closed.
+type blockingRetriever struct {
+	closed chan struct{}
+}
+
+func (br blockingRetriever) GetPkg(name string, arch pkgen.Arch) (io.ReadCloser, int64, error) {
+	return &blockingReader{closed: br.closed}, -1, nil
+}
+
+type blockingReader struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (br *blockingReader) Read(dat []byte) (int, error) {
+	<-br.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (br *blockingReader) Close() error {
+	br.once.Do(func() { close(br.closed) })
+	return nil
+}
+
+func TestHashCacheCancelBlocked(t *testing.T) {
+	br := blockingRetriever{closed: make(chan struct{})}
+	hc := NewHashCache(br)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	errch := make(chan error, 1)
+	go func() {
+		_, err := hc.PackageHash(ctx, "example", pkgen.Archx86_64)
+		errch <- err
+	}()
+	select {
+	case err := <-errch:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked read was not cancelled")
+	}
+}
+
+func TestRebuildReasons(t *testing.T) {
+	pkg := &pkgen.PackageGenerator{
+		Packages: map[string]pkgen.Package{"example": {}},
+		Sources: []*url.URL{
+			{Scheme: "file", Path: "/example.patch"},
+			{Scheme: "https", Host: "example.com", Path: "/example.tar.gz"},
+		},
+		BuildArch: pkgen.Archx86_64,
+	}
+	img := Image{Image: "sha256:" + strings.Repeat("0", 64)}
+	hash := func(patch string) Info {
+		loader := pkgen.FileLoader(mapfs.New(map[string]string{
+			"example.patch": patch,
+		}))
+		h, inputs, err := HashPackageInputs(context.Background(), pkg, loader, NewHashCache(MemStore()), img, RawPackageIndex{})
+		if err != nil {
+			t.Fatalf("failed to hash package: %s", err.Error())
+		}
+		return Info{
+			PackageName: "example",
+			Arch:        pkgen.Archx86_64,
+			Hash:        h,
+			Inputs:      inputs,
+		}
+	}
+
+	old := hash("a")
+	if reasons := RebuildReasons(old, hash("a")); len(reasons) != 0 {
+		t.Errorf("unexpected rebuild reasons %q", reasons)
+	}
+	reasons := RebuildReasons(old, hash("b"))
+	if expect := []string{"file:///example.patch changed"}; !reflect.DeepEqual(reasons, expect) {
+		t.Errorf("expected %q but got %q", expect, reasons)
+	}
+}
+
+func TestDirJSONCacheLoadAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsoncache")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	jc := DirJSONCache(dir)
+	a := Info{PackageName: "a", Arch: pkgen.Archx86_64, Hash: [32]byte{1}}
+	err = jc.Update(a)
+	if err != nil {
+		t.Fatalf("failed to update cache: %s", err.Error())
+	}
+
+	c, err := jc.(BatchValidator).LoadAll()
+	if err != nil {
+		t.Fatalf("failed to load cache: %s", err.Error())
+	}
+	b := Info{PackageName: "b", Arch: pkgen.Archx86_64, Hash: [32]byte{2}}
+	err = c.Update(b)
+	if err != nil {
+		t.Fatalf("failed to update cache: %s", err.Error())
+	}
+	for _, v := range []Info{a, b} {
+		for _, bc := range []BuildCache{jc, c} {
+			ok, err := bc.Valid(v)
+			if err != nil {
+				t.Fatalf("failed to validate: %s", err.Error())
+			}
+			if !ok {
+				t.Errorf("expected %q to be valid", v.PackageName)
+			}
+		}
+	}
+	ok, err := c.Valid(Info{PackageName: "a", Arch: pkgen.Archx86_64})
+	if err != nil || ok {
+		t.Errorf("expected hash mismatch to be invalid")
+	}
+}
+
+func TestDirJSONCacheCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsoncache")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	jc := DirJSONCache(dir)
+	info := Info{PackageName: "a", Arch: pkgen.Archx86_64, Hash: [32]byte{1}}
+	err = jc.Update(info)
+	if err != nil {
+		t.Fatalf("failed to update cache: %s", err.Error())
+	}
+	path := filepath.Join(dir, "a-x86_64.json")
+	good, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read cache file: %s", err.Error())
+	}
+
+	legacy := []byte(`{"name":"a","arch":"x86_64","hash":[1,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0]}`)
+
+	tbl := []struct {
+		name  string
+		dat   []byte
+		valid bool
+	}{
+		{"valid", good, true},
+		{"truncated", good[:len(good)/2], false},
+		{"edited", bytes.Replace(good, []byte(`"name":"a"`), []byte(`"name":"b"`), 1), false},
+		{"legacy", legacy, true},
+		{"truncated legacy", legacy[:len(legacy)/2], false},
+		{"edited sum", bytes.Replace(good, []byte(`"sum":"`), []byte(`"sum":"0`), 1), false},
+	}
+	for _, v := range tbl {
+		t.Run(v.name, func(t *testing.T) {
+			err := ioutil.WriteFile(path, v.dat, 0644)
+			if err != nil {
+				t.Fatalf("failed to write cache file: %s", err.Error())
+			}
+			c, err := jc.(BatchValidator).LoadAll()
+			if err != nil {
+				t.Fatalf("failed to load cache: %s", err.Error())
+			}
+			for _, bc := range []BuildCache{jc, c} {
+				ok, err := bc.Valid(info)
+				if err != nil {
+					t.Fatalf("failed to validate: %s", err.Error())
+				}
+				if ok != v.valid {
+					t.Errorf("expected valid=%v but got %v", v.valid, ok)
+				}
+			}
+		})
+	}
+
+	// corrupt entries are replaced on update
+	err = jc.Update(info)
+	if err != nil {
+		t.Fatalf("failed to update cache: %s", err.Error())
+	}
+	ok, err := jc.Valid(info)
+	if err != nil || !ok {
+		t.Errorf("expected replaced entry to be valid (err: %v)", err)
+	}
+
+	// legacy entries are rewritten with a checksum on update
+	err = ioutil.WriteFile(path, legacy, 0644)
+	if err != nil {
+		t.Fatalf("failed to write cache file: %s", err.Error())
+	}
+	err = jc.Update(info)
+	if err != nil {
+		t.Fatalf("failed to update cache: %s", err.Error())
+	}
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read cache file: %s", err.Error())
+	}
+	if !bytes.Equal(dat, good) {
+		t.Errorf("expected checksummed entry but got %s", dat)
+	}
+}
+
+func BenchmarkDirJSONCache(b *testing.B) {
+	dir, err := ioutil.TempDir("", "jsoncache")
+	if err != nil {
+		b.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	jc := DirJSONCache(dir)
+	infos := make([]Info, 300)
+	for i := range infos {
+		infos[i] = Info{PackageName: fmt.Sprintf("pkg%d", i), Arch: pkgen.Archx86_64}
+		err = jc.Update(infos[i])
+		if err != nil {
+			b.Fatalf("failed to update cache: %s", err.Error())
+		}
+	}
+	validate := func(bc BuildCache) {
+		for _, v := range infos {
+			_, err := bc.Valid(v)
+			if err != nil {
+				b.Fatalf("failed to validate: %s", err.Error())
+			}
+		}
+	}
+
+	b.Run("PerJob", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			validate(jc)
+		}
+	})
+	b.Run("Batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c, err := jc.(BatchValidator).LoadAll()
+			if err != nil {
+				b.Fatalf("failed to load cache: %s", err.Error())
+			}
+			validate(c)
+		}
+	})
+}
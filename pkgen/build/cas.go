@@ -0,0 +1,137 @@
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+// ErrPackageCorrupt is an error indicating that the content of a stored package does not match the expected checksum.
+var ErrPackageCorrupt = errors.New("package is corrupt")
+
+// casStore is a content-addressed PackageStore.
+// Package content is stored in blobs/<sha256>, and <name>-<arch>.tar.gz is a symlink to the blob.
+type casStore struct {
+	dir string
+}
+
+func (cs casStore) blobDir() string {
+	return filepath.Join(cs.dir, "blobs")
+}
+
+func (cs casStore) Store(name string, arch pkgen.Arch, body io.Reader) (err error) {
+	// create blob directory
+	err = os.MkdirAll(cs.blobDir(), 0755)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file while hashing
+	f, err := ioutil.TempFile(cs.blobDir(), ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), body)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	if cerr != nil {
+		return cerr
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	// move into place
+	// identical blobs are deduplicated by name
+	// an existing blob is replaced, in case it is corrupt
+	blob := filepath.Join(cs.blobDir(), sum)
+	err = os.Chmod(tmp, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, blob)
+	if err != nil {
+		return err
+	}
+
+	// atomically replace symlink
+	link := filepath.Join(cs.dir, name+"-"+arch.String()+".tar.gz")
+	tmplink := link + ".tmp"
+	os.Remove(tmplink)
+	err = os.Symlink(filepath.Join("blobs", sum), tmplink)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmplink, link)
+	if err != nil {
+		os.Remove(tmplink)
+		return err
+	}
+
+	return nil
+}
+
+func (cs casStore) GetPkg(name string, arch pkgen.Arch) (io.ReadCloser, int64, error) {
+	// check arch validity
+	if !arch.Supported() {
+		return nil, -1, pkgen.ErrUnsupportedArch
+	}
+
+	// look up blob
+	target, err := os.Readlink(filepath.Join(cs.dir, name+"-"+arch.String()+".tar.gz"))
+	if err != nil {
+		return nil, -1, err
+	}
+	sum, err := hex.DecodeString(filepath.Base(target))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, -1, ErrPackageCorrupt
+	}
+
+	// open blob
+	f, err := os.Open(filepath.Join(cs.blobDir(), filepath.Base(target)))
+	if err != nil {
+		return nil, -1, err
+	}
+
+	// verify blob
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		f.Close()
+		return nil, -1, err
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		f.Close()
+		return nil, -1, ErrPackageCorrupt
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, -1, err
+	}
+
+	return f, n, nil
+}
+
+// CASStore creates a content-addressed PackageStore in a directory.
+// Package content is stored in the "blobs" subdirectory by SHA256 hash, so identical packages are only stored once.
+// Each package is a symlink <name>-<arch>.tar.gz pointing to the blob.
+// GetPkg verifies the blob against its hash, and returns ErrPackageCorrupt on a mismatch.
+// Storing a package again replaces its blob, so a corrupt blob is repaired by a rebuild.
+func CASStore(dir string) PackageStore {
+	return casStore{dir: dir}
+}
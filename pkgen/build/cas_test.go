@@ -0,0 +1,92 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+func TestCASStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "casstore")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	cs := CASStore(dir)
+
+	// store packages
+	for _, v := range []string{"a", "b"} {
+		err = cs.Store(v, pkgen.Archx86_64, strings.NewReader("content"))
+		if err != nil {
+			t.Fatalf("failed to store %q: %s", v, err.Error())
+		}
+	}
+	err = cs.Store("c", pkgen.Archx86_64, strings.NewReader("other content"))
+	if err != nil {
+		t.Fatalf("failed to store %q: %s", "c", err.Error())
+	}
+
+	// retrieve packages
+	for _, v := range []struct{ name, content string }{
+		{"a", "content"},
+		{"b", "content"},
+		{"c", "other content"},
+	} {
+		rc, n, err := cs.GetPkg(v.name, pkgen.Archx86_64)
+		if err != nil {
+			t.Fatalf("failed to get %q: %s", v.name, err.Error())
+		}
+		dat, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("failed to read %q: %s", v.name, err.Error())
+		}
+		if string(dat) != v.content || n != int64(len(v.content)) {
+			t.Errorf("expected %q (%d bytes) but got %q (%d bytes)", v.content, len(v.content), string(dat), n)
+		}
+	}
+
+	// identical content is deduplicated
+	blobs, err := ioutil.ReadDir(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatalf("failed to read blobs: %s", err.Error())
+	}
+	if len(blobs) != 2 {
+		t.Errorf("expected 2 blobs but found %d", len(blobs))
+	}
+
+	// corruption is detected
+	target, err := filepath.EvalSymlinks(filepath.Join(dir, "a-x86_64.tar.gz"))
+	if err != nil {
+		t.Fatalf("failed to resolve symlink: %s", err.Error())
+	}
+	err = ioutil.WriteFile(target, []byte("corrupted"), 0644)
+	if err != nil {
+		t.Fatalf("failed to corrupt blob: %s", err.Error())
+	}
+	_, _, err = cs.GetPkg("b", pkgen.Archx86_64)
+	if err != ErrPackageCorrupt {
+		t.Errorf("expected ErrPackageCorrupt but got %v", err)
+	}
+
+	// storing the package again repairs the blob
+	err = cs.Store("a", pkgen.Archx86_64, strings.NewReader("content"))
+	if err != nil {
+		t.Fatalf("failed to store %q: %s", "a", err.Error())
+	}
+	for _, v := range []string{"a", "b"} {
+		rc, _, err := cs.GetPkg(v, pkgen.Archx86_64)
+		if err != nil {
+			t.Fatalf("failed to get %q after repair: %s", v, err.Error())
+		}
+		dat, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(dat) != "content" {
+			t.Errorf("expected %q after repair but got %q (err: %v)", "content", dat, err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package build
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DependencyCache is a DependencyFinder which caches the results of another DependencyFinder.
+// A DependencyCache is safe for concurrent use.
+type DependencyCache struct {
+	df DependencyFinder
+
+	lck   sync.Mutex
+	cache map[string][]string
+}
+
+// CachedDependencyFinder creates a DependencyCache which caches the results of df.
+// Results are keyed by the sorted set of input packages, and the sorted input set is passed to df.
+// If the packages known to df change, Invalidate must be called.
+func CachedDependencyFinder(df DependencyFinder) *DependencyCache {
+	return &DependencyCache{
+		df:    df,
+		cache: map[string][]string{},
+	}
+}
+
+// FindDependencies finds the dependencies of the given packages recursively.
+// Errors are not cached.
+func (dc *DependencyCache) FindDependencies(pkgs ...string) ([]string, error) {
+	// generate key
+	sorted := make([]string, len(pkgs))
+	copy(sorted, pkgs)
+	sort.Strings(sorted)
+	key := strings.Join(sorted, "\x00")
+
+	// lookup in cache
+	dc.lck.Lock()
+	deps, ok := dc.cache[key]
+	dc.lck.Unlock()
+	if !ok {
+		var err error
+		deps, err = dc.df.FindDependencies(sorted...)
+		if err != nil {
+			return nil, err
+		}
+		dc.lck.Lock()
+		dc.cache[key] = deps
+		dc.lck.Unlock()
+	}
+
+	// copy result so that the cache cannot be modified by the caller
+	res := make([]string, len(deps))
+	copy(res, deps)
+
+	return res, nil
+}
+
+// Invalidate clears the cache.
+func (dc *DependencyCache) Invalidate() {
+	dc.lck.Lock()
+	defer dc.lck.Unlock()
+	dc.cache = map[string][]string{}
+}
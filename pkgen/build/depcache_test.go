@@ -0,0 +1,98 @@
+package build
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+// testDepIndex creates a RawPackageIndex of n packages, where each package depends on the previous two.
+func testDepIndex(n int) RawPackageIndex {
+	rpi := RawPackageIndex{}
+	for i := 0; i < n; i++ {
+		deps := []string{}
+		for j := i - 2; j < i; j++ {
+			if j >= 0 {
+				deps = append(deps, fmt.Sprintf("pkg%d", j))
+			}
+		}
+		name := fmt.Sprintf("pkg%d", i)
+		rpi.addPkent(&RawPkent{
+			Path: name + "/pkgen.yaml",
+			Pkgen: &pkgen.RawPackageGenerator{
+				Packages: map[string]pkgen.Package{
+					name: {Dependencies: deps},
+				},
+			},
+		})
+	}
+	return rpi
+}
+
+func TestCachedDependencyFinder(t *testing.T) {
+	rpi := testDepIndex(20)
+	dc := CachedDependencyFinder(rpi)
+	for _, v := range [][]string{
+		{"pkg5"},
+		{"pkg19"},
+		{"pkg3", "pkg10"},
+		{"pkg3", "pkg10"},
+		{"pkg5"},
+	} {
+		expect, err := rpi.FindDependencies(v...)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		deps, err := dc.FindDependencies(v...)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if !reflect.DeepEqual(deps, expect) {
+			t.Errorf("expected %v but got %v", expect, deps)
+		}
+	}
+
+	// modifying the result does not modify the cache
+	deps, _ := dc.FindDependencies("pkg1")
+	deps[0] = "modified"
+	deps, _ = dc.FindDependencies("pkg1")
+	if deps[0] == "modified" {
+		t.Error("cache was modified")
+	}
+
+	// errors are reported
+	_, err := dc.FindDependencies("missing")
+	if _, ok := err.(ErrPkgNotFound); !ok {
+		t.Errorf("expected ErrPkgNotFound but got %v", err)
+	}
+
+	// invalidation picks up index changes
+	rpi["pkg1"].Pkgen.Packages["pkg1"] = pkgen.Package{Dependencies: []string{}}
+	dc.Invalidate()
+	deps, _ = dc.FindDependencies("pkg1")
+	if expect := []string{"pkg1"}; !reflect.DeepEqual(deps, expect) {
+		t.Errorf("expected %v after invalidation but got %v", expect, deps)
+	}
+}
+
+func BenchmarkFindDependencies(b *testing.B) {
+	rpi := testDepIndex(300)
+	lst := rpi.List()
+	b.Run("Uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, v := range lst {
+				rpi.FindDependencies(v)
+			}
+		}
+	})
+	b.Run("Cached", func(b *testing.B) {
+		dc := CachedDependencyFinder(rpi)
+		for i := 0; i < b.N; i++ {
+			for _, v := range lst {
+				dc.FindDependencies(v)
+			}
+		}
+	})
+}
@@ -1,15 +1,47 @@
 package build
 
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrDependencyCycle is an error type indicating that a dependency cycle was found.
+type ErrDependencyCycle struct {
+	// Packages is the list of packages in the cycle.
+	// The first package is repeated at the end.
+	Packages []string
+}
+
+func (err ErrDependencyCycle) Error() string {
+	return fmt.Sprintf("dependency cycle: %s", strings.Join(err.Packages, " -> "))
+}
+func (err ErrDependencyCycle) String() string {
+	return err.Error()
+}
+
 // DepWalker is a function to walk a package dependency tree.
 type DepWalker func(string) ([]string, error)
 
 // Walk walks the dependency tree.
+// Dependency cycles are tolerated (runtime dependencies may be mutual), and each package is only listed once.
 func (dw DepWalker) Walk(pkgs ...string) ([]string, error) {
+	return dw.walk(false, pkgs...)
+}
+
+// CheckCycles walks the dependency tree like Walk, but returns an ErrDependencyCycle if a dependency cycle is found.
+func (dw DepWalker) CheckCycles(pkgs ...string) error {
+	_, err := dw.walk(true, pkgs...)
+	return err
+}
+
+func (dw DepWalker) walk(strict bool, pkgs ...string) ([]string, error) {
 	// create walk tracker
 	ds := &depSet{
 		depscan: make(map[string]struct{}),
+		active:  make(map[string]int),
 		lst:     []string{},
 		walker:  dw,
+		strict:  strict,
 	}
 
 	// walk dependencies
@@ -27,18 +59,35 @@ func (dw DepWalker) Walk(pkgs ...string) ([]string, error) {
 // depSet is a set of dependencies used to walk dependencies.
 type depSet struct {
 	depscan map[string]struct{}
+	active  map[string]int // index of packages in path
+	path    []string       // packages currently being walked
 	lst     []string
 	walker  DepWalker
+	strict  bool // whether to fail on cycles
 }
 
 // walk runs a recursive dependency walk.
 func (ds *depSet) walk(pkgname string) error {
+	// detect cycles
+	if i, ok := ds.active[pkgname]; ok && ds.strict {
+		cycle := append([]string{}, ds.path[i:]...)
+		return ErrDependencyCycle{Packages: append(cycle, pkgname)}
+	}
+
 	// dont rescan a dependency
 	if _, ok := ds.depscan[pkgname]; ok {
 		return nil
 	}
 	ds.depscan[pkgname] = struct{}{}
 
+	// track package in path
+	ds.active[pkgname] = len(ds.path)
+	ds.path = append(ds.path, pkgname)
+	defer func() {
+		delete(ds.active, pkgname)
+		ds.path = ds.path[:len(ds.path)-1]
+	}()
+
 	// get dependencies
 	deps, err := ds.walker(pkgname)
 	if err != nil {
@@ -0,0 +1,78 @@
+package build
+
+import (
+	"reflect"
+	"testing"
+)
+
+// mapWalker returns a DepWalker using a map of package names to dependencies.
+func mapWalker(deps map[string][]string) DepWalker {
+	return func(pkg string) ([]string, error) {
+		d, ok := deps[pkg]
+		if !ok {
+			return nil, ErrPkgNotFound{pkg}
+		}
+		return d, nil
+	}
+}
+
+func TestWalk(t *testing.T) {
+	dw := mapWalker(map[string][]string{
+		"a": {"b", "c"},
+		"b": {"c"},
+		"c": {},
+	})
+	lst, err := dw.Walk("a")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if expect := []string{"c", "b", "a"}; !reflect.DeepEqual(lst, expect) {
+		t.Errorf("expected %v but got %v", expect, lst)
+	}
+}
+
+func TestWalkCycle(t *testing.T) {
+	tbl := []struct {
+		deps  map[string][]string
+		start string
+		cycle []string
+	}{
+		{
+			deps: map[string][]string{
+				"a": {"b"},
+				"b": {"a"},
+			},
+			start: "a",
+			cycle: []string{"a", "b", "a"},
+		},
+		{
+			deps: map[string][]string{
+				"x": {"a"},
+				"a": {"b"},
+				"b": {"c"},
+				"c": {"a"},
+			},
+			start: "x",
+			cycle: []string{"a", "b", "c", "a"},
+		},
+	}
+	for _, v := range tbl {
+		// cycles are tolerated by Walk
+		lst, err := mapWalker(v.deps).Walk(v.start)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err.Error())
+		} else if len(lst) != len(v.deps) {
+			t.Errorf("expected %d packages but got %v", len(v.deps), lst)
+		}
+
+		err = mapWalker(v.deps).CheckCycles(v.start)
+		cerr, ok := err.(ErrDependencyCycle)
+		if !ok {
+			t.Errorf("expected ErrDependencyCycle but got %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(cerr.Packages, v.cycle) {
+			t.Errorf("expected cycle %v but got %v", v.cycle, cerr.Packages)
+		}
+	}
+}
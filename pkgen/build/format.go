@@ -0,0 +1,151 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// PackageFormat is a compression format for packages.
+type PackageFormat string
+
+// Supported package formats.
+const (
+	FormatGzip PackageFormat = "gz"
+	FormatXZ   PackageFormat = "xz"
+	FormatZstd PackageFormat = "zst"
+)
+
+// packageFormats is a list of supported package formats.
+var packageFormats = []PackageFormat{FormatGzip, FormatXZ, FormatZstd}
+
+// ErrUnknownFormat is an error indicating that the format of a package was not recognized.
+var ErrUnknownFormat = errors.New("unknown package format")
+
+// Ext returns the file extension of a package in the format (e.g. ".tar.gz").
+func (pf PackageFormat) Ext() string {
+	return ".tar." + string(pf)
+}
+
+// String returns the name of the format.
+func (pf PackageFormat) String() string {
+	return string(pf)
+}
+
+// magic returns the magic number at the start of data in the format.
+func (pf PackageFormat) magic() []byte {
+	switch pf {
+	case FormatGzip:
+		return []byte{0x1f, 0x8b}
+	case FormatXZ:
+		return []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	case FormatZstd:
+		return []byte{0x28, 0xb5, 0x2f, 0xfd}
+	default:
+		return nil
+	}
+}
+
+// reader wraps an io.Reader with decompression.
+func (pf PackageFormat) reader(r io.Reader) (io.ReadCloser, error) {
+	switch pf {
+	case FormatGzip:
+		return gzip.NewReader(r)
+	case FormatXZ:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	case FormatZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+// writer wraps an io.Writer with compression.
+// Closing the returned io.WriteCloser does not close the underlying io.Writer.
+func (pf PackageFormat) writer(w io.Writer) (io.WriteCloser, error) {
+	switch pf {
+	case FormatGzip:
+		return gzip.NewWriter(w), nil
+	case FormatXZ:
+		return xz.NewWriter(w)
+	case FormatZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+// FormatFromName gets the format of a package from its file name.
+func FormatFromName(name string) (PackageFormat, error) {
+	for _, f := range packageFormats {
+		if strings.HasSuffix(name, f.Ext()) {
+			return f, nil
+		}
+	}
+	return "", ErrUnknownFormat
+}
+
+// detectFormat detects the format of a package from its magic number.
+func detectFormat(br *bufio.Reader) (PackageFormat, error) {
+	for _, f := range packageFormats {
+		m := f.magic()
+		dat, err := br.Peek(len(m))
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if bytes.Equal(dat, m) {
+			return f, nil
+		}
+	}
+	return "", ErrUnknownFormat
+}
+
+// convertFormat converts a package into the given format.
+// The format of the input is detected automatically.
+func convertFormat(r io.Reader, format PackageFormat) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	in, err := detectFormat(br)
+	if err != nil {
+		return nil, err
+	}
+	if in == format {
+		return ioutil.NopCloser(br), nil
+	}
+
+	// transcode
+	dec, err := in.reader(br)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer dec.Close()
+		enc, err := format.writer(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(enc, dec)
+		cerr := enc.Close()
+		if err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
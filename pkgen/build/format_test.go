@@ -0,0 +1,125 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+// gzipData compresses data with gzip.
+func gzipData(t *testing.T, dat []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write(dat)
+	if err != nil {
+		t.Fatalf("failed to compress: %s", err.Error())
+	}
+	err = gw.Close()
+	if err != nil {
+		t.Fatalf("failed to compress: %s", err.Error())
+	}
+	return buf.Bytes()
+}
+
+func TestDirStoreFormat(t *testing.T) {
+	pkg := gzipData(t, []byte("package content"))
+	for _, f := range packageFormats {
+		t.Run(f.String(), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "dirstore")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %s", err.Error())
+			}
+			defer os.RemoveAll(dir)
+			ds := DirStore(dir, DirStoreOptions{Verify: true, Format: f})
+
+			err = ds.Store("example", pkgen.Archx86_64, bytes.NewReader(pkg))
+			if err != nil {
+				t.Fatalf("failed to store package: %s", err.Error())
+			}
+			_, err = os.Stat(filepath.Join(dir, "example-x86_64"+f.Ext()))
+			if err != nil {
+				t.Fatalf("package not stored in %s format: %s", f, err.Error())
+			}
+
+			rc, n, err := ds.GetPkg("example", pkgen.Archx86_64)
+			if err != nil {
+				t.Fatalf("failed to get package: %s", err.Error())
+			}
+			defer rc.Close()
+			dat, err := ioutil.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("failed to read package: %s", err.Error())
+			}
+			if int64(len(dat)) != n {
+				t.Errorf("expected %d bytes but got %d", n, len(dat))
+			}
+			df, err := detectFormat(bufio.NewReader(bytes.NewReader(dat)))
+			if err != nil || df != f {
+				t.Errorf("expected %s format but got %q (%v)", f, df, err)
+			}
+			dr, err := f.reader(bytes.NewReader(dat))
+			if err != nil {
+				t.Fatalf("failed to decompress: %s", err.Error())
+			}
+			defer dr.Close()
+			dat, err = ioutil.ReadAll(dr)
+			if err != nil {
+				t.Fatalf("failed to decompress: %s", err.Error())
+			}
+			if string(dat) != "package content" {
+				t.Errorf("unexpected package content %q", string(dat))
+			}
+		})
+	}
+}
+
+func TestDirStoreFormatCompat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirstore")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// store with legacy gzip store
+	pkg := gzipData(t, []byte("package content"))
+	err = DirStore(dir, DirStoreOptions{}).Store("example", pkgen.Archx86_64, bytes.NewReader(pkg))
+	if err != nil {
+		t.Fatalf("failed to store package: %s", err.Error())
+	}
+
+	// read with zstd store
+	rc, _, err := DirStore(dir, DirStoreOptions{Format: FormatZstd}).GetPkg("example", pkgen.Archx86_64)
+	if err != nil {
+		t.Fatalf("failed to get package: %s", err.Error())
+	}
+	dat, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("failed to read package: %s", err.Error())
+	}
+	if !bytes.Equal(dat, pkg) {
+		t.Error("package content changed")
+	}
+}
+
+func TestFormatFromName(t *testing.T) {
+	tbl := map[string]PackageFormat{
+		"./example.tar.gz":  FormatGzip,
+		"./example.tar.xz":  FormatXZ,
+		"./example.tar.zst": FormatZstd,
+		"./example.tar":     "",
+		"./example":         "",
+	}
+	for name, expect := range tbl {
+		f, err := FormatFromName(name)
+		if f != expect || (expect == "" && err != ErrUnknownFormat) {
+			t.Errorf("expected %q for %q but got %q (%v)", expect, name, f, err)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package build
 
 import (
 	"context"
+	"fmt"
 	"path/filepath"
 
 	"gitlab.com/jadr2ddude/xgraph"
@@ -20,18 +21,36 @@ type GraphOptions struct {
 	HashCache *HashCache
 
 	// Cache is the BuildCache to use to implement incremental builds.
+	// If the BuildCache implements BatchValidator, all entries are loaded when creating the graph.
 	Cache BuildCache
 
+	// RebuildReasonCallback is called with the reasons when a cached package needs to be rebuilt.
+	// Optional - requires Cache to implement InfoLookup.
+	RebuildReasonCallback func(info Info, reasons []string)
+
+	// ForceRebuild forces all packages to be rebuilt, even if they are cached.
+	// The cache is still updated after each build.
+	ForceRebuild bool
+
 	// Logger is a logging mechanism to use for build jobs.
 	Logger buildlog.Logger
 
 	// Arch is the arch to build on.
 	Arch pkgen.Arch
 
+	// BuildArch is the arch to build packages for.
+	// Optional - defaults to Arch.
+	// If this is a cross build, only pkgens supporting cross compilation are included.
+	// Build dependencies of cross builds are installed for Arch, and must already be available from Packages (e.g. from a native graph).
+	BuildArch pkgen.Arch
+
 	// SourceTree is a vfs used to store the rootfs.
 	SourceTree vfs.FileSystem
 
 	rpi RawPackageIndex
+
+	// excluded maps the names of jobs which were left out of the graph to the reason
+	excluded map[string]string
 }
 
 // job is a build job.
@@ -48,24 +67,64 @@ func (j *job) Name() string {
 }
 
 func (j *job) ShouldRun() (bool, error) {
-	hash, err := HashPackage(context.Background(), j.pkg, j.loader, j.gopts.HashCache, j.gopts.DockerImage, j.gopts.Dependencies)
+	ctx := j.gopts.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	hash, inputs, err := HashPackageInputs(ctx, j.pkg, j.loader, j.gopts.HashCache, j.gopts.DockerImage, j.gopts.Dependencies)
 	if err != nil {
 		return false, err
 	}
 	j.info.Hash = hash
+	j.info.Inputs = inputs
+	if j.gopts.ForceRebuild {
+		return true, nil
+	}
 	ok, err := j.gopts.Cache.Valid(j.info)
 	if err != nil {
 		return false, nil
 	}
+	if !ok && j.gopts.RebuildReasonCallback != nil {
+		j.reportRebuild()
+	}
 	return !ok, nil
 }
 
+// reportRebuild sends the reasons for a rebuild to the RebuildReasonCallback.
+func (j *job) reportRebuild() {
+	il, ok := j.gopts.Cache.(InfoLookup)
+	if !ok {
+		return
+	}
+	cached, found, err := il.Lookup(j.info.PackageName, j.info.Arch)
+	var reasons []string
+	switch {
+	case err != nil:
+		reasons = []string{fmt.Sprintf("failed to read cache: %s", err.Error())}
+	case !found:
+		reasons = []string{"not previously built"}
+	default:
+		reasons = RebuildReasons(cached, j.info)
+	}
+	j.gopts.RebuildReasonCallback(j.info, reasons)
+}
+
 func (j *job) Dependencies() ([]string, error) {
 	deps, err := BuildDepsDocker(j.pkg, j.gopts.Dependencies, j.gopts.DockerImage)
 	if err != nil {
 		return nil, err
 	}
-	return mapRuleDeps(j.gopts.rpi, j.gopts.Arch, deps...), nil
+	if pkgen.IsCross(j.gopts.Arch, j.gopts.BuildArch) {
+		// build dependencies are host arch packages, which are not built by this graph
+		return []string{}, nil
+	}
+	rdeps := mapRuleDeps(j.gopts.rpi, j.gopts.BuildArch, deps...)
+	for _, d := range rdeps {
+		if reason, ok := j.gopts.excluded[d]; ok {
+			return nil, fmt.Errorf("build dependency %q of %q is not in the graph: %s", d, j.Name(), reason)
+		}
+	}
+	return rdeps, nil
 }
 
 func (j *job) Run(ctx context.Context) error {
@@ -100,7 +159,7 @@ func newJob(pkg *RawPkent, opts *GraphOptions) (*job, error) {
 	}
 
 	// preprocess pkgen
-	p, err := pkg.Pkgen.Preprocess(opts.Arch, opts.Arch, false)
+	p, err := pkg.Pkgen.Preprocess(opts.Arch, opts.BuildArch, false)
 	if err != nil {
 		return nil, err
 	}
@@ -109,7 +168,7 @@ func newJob(pkg *RawPkent, opts *GraphOptions) (*job, error) {
 	return &job{
 		info: Info{
 			PackageName: filepath.Base(filepath.Dir(pkg.Path)),
-			Arch:        opts.Arch,
+			Arch:        opts.BuildArch,
 		},
 		loader: loader,
 		pkg:    p,
@@ -119,14 +178,29 @@ func newJob(pkg *RawPkent, opts *GraphOptions) (*job, error) {
 
 // Graph creates a *xgraph.Graph for mass-building packages.
 // A meta-rule called "all" is created, which depends on all package rules.
+// Jobs are created in sorted order, so the graph is the same on every run.
+// Pkgens which do not support the build arch (or cross compilation, for cross builds) are left out of the graph.
+// In a native graph, finding the dependencies of a job which depends on one of them fails with an error naming the dependency.
 func Graph(rpi RawPackageIndex, opts GraphOptions) (*xgraph.Graph, error) {
 	// fix graph options
 	if opts.HashCache == nil {
-		opts.HashCache = &HashCache{
-			m:  map[hashCacheKey]*hashCacheEntry{},
-			pr: opts.Packages,
+		opts.HashCache = NewHashCache(opts.Packages)
+	}
+	if opts.BuildArch == "" {
+		opts.BuildArch = opts.Arch
+	}
+	if _, ok := opts.Dependencies.(*DependencyCache); !ok && opts.Dependencies != nil {
+		// each job looks up dependencies several times
+		opts.Dependencies = CachedDependencyFinder(opts.Dependencies)
+	}
+	if bv, ok := opts.Cache.(BatchValidator); ok {
+		c, err := bv.LoadAll()
+		if err != nil {
+			return nil, err
 		}
+		opts.Cache = c
 	}
+	cross := pkgen.IsCross(opts.Arch, opts.BuildArch)
 	opts.rpi = rpi
 
 	// create graph
@@ -134,10 +208,16 @@ func Graph(rpi RawPackageIndex, opts GraphOptions) (*xgraph.Graph, error) {
 
 	// find pkgens
 	rules := []string{}
+	opts.excluded = map[string]string{}
 	lst := rpi.List()
 	for _, name := range lst {
-		ent, ok := rpi[name]
-		if ok && ent.Pkgen.Arch.Supports(opts.Arch) {
+		ent := rpi[name]
+		switch {
+		case !ent.Pkgen.Arch.Supports(opts.BuildArch):
+			opts.excluded[name+":"+opts.BuildArch.String()] = fmt.Sprintf("pkgen does not support %s", opts.BuildArch)
+		case cross && !ent.Pkgen.Cross:
+			// cross jobs do not depend on other jobs
+		default:
 			// create job
 			job, err := newJob(ent, &opts)
 			if err != nil {
@@ -0,0 +1,230 @@
+package build
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab.com/panux/builder/pkgen"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+func TestMapRuleDeps(t *testing.T) {
+	rpi := testDepIndex(6)
+	deps := mapRuleDeps(rpi, pkgen.Archx86_64, "pkg4", "pkg1", "pkg3", "pkg1")
+	if expect := []string{"pkg1:x86_64", "pkg3:x86_64", "pkg4:x86_64"}; !reflect.DeepEqual(deps, expect) {
+		t.Errorf("expected %v but got %v", expect, deps)
+	}
+}
+
+func TestBuildDepsDocker(t *testing.T) {
+	rpi := testDepIndex(4)
+	deps, err := BuildDepsDocker(&pkgen.PackageGenerator{
+		BuildDependencies: []string{"pkg3"},
+	}, rpi, Image{Packages: []string{"pkg0"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if expect := []string{"pkg1", "pkg2", "pkg3"}; !reflect.DeepEqual(deps, expect) {
+		t.Errorf("expected %v but got %v", expect, deps)
+	}
+}
+
+func TestGraphOrder(t *testing.T) {
+	rpi := testDepIndex(20)
+	for _, ent := range rpi {
+		ent.Pkgen.Version = "1.0"
+		ent.Pkgen.Arch = pkgen.ArchSet{pkgen.ArchAll}
+		ent.Pkgen.Script = []string{"true"}
+		for _, p := range ent.Pkgen.Packages {
+			ent.Pkgen.BuildDependencies = p.Dependencies
+		}
+	}
+	fs := mapfs.New(map[string]string{})
+	var prev [][]string
+	for i := 0; i < 5; i++ {
+		g, err := Graph(rpi, GraphOptions{
+			Options: Options{
+				Loader:       pkgen.FileLoader(fs),
+				Dependencies: rpi,
+			},
+			Arch:       pkgen.Archx86_64,
+			SourceTree: fs,
+		})
+		if err != nil {
+			t.Fatalf("failed to create graph: %s", err.Error())
+		}
+
+		// collect job order
+		all, err := g.GetJob("all")
+		if err != nil {
+			t.Fatalf("failed to get job: %s", err.Error())
+		}
+		rules, err := all.Dependencies()
+		if err != nil {
+			t.Fatalf("failed to get rules: %s", err.Error())
+		}
+		order := [][]string{rules}
+		for _, r := range rules {
+			j, err := g.GetJob(r)
+			if err != nil {
+				t.Fatalf("failed to get job: %s", err.Error())
+			}
+			deps, err := j.Dependencies()
+			if err != nil {
+				t.Fatalf("failed to get dependencies: %s", err.Error())
+			}
+			order = append(order, deps)
+		}
+		if prev != nil && !reflect.DeepEqual(order, prev) {
+			t.Fatalf("graph order changed: %v != %v", order, prev)
+		}
+		prev = order
+	}
+}
+
+func TestForceRebuild(t *testing.T) {
+	rpi := testDepIndex(1)
+	rpi["pkg0"].Pkgen.Version = "1.0"
+	rpi["pkg0"].Pkgen.Arch = pkgen.ArchSet{pkgen.ArchAll}
+	rpi["pkg0"].Pkgen.Script = []string{"true"}
+	fs := mapfs.New(map[string]string{})
+	cache := KVCache(&mapKV{m: map[string][]byte{}}, "")
+	for _, force := range []bool{false, true} {
+		g, err := Graph(rpi, GraphOptions{
+			Options: Options{
+				Loader:       pkgen.FileLoader(fs),
+				Dependencies: rpi,
+				DockerImage:  Image{Image: "sha256:" + strings.Repeat("00", 32)},
+			},
+			Cache:        cache,
+			ForceRebuild: force,
+			Arch:         pkgen.Archx86_64,
+			SourceTree:   fs,
+		})
+		if err != nil {
+			t.Fatalf("failed to create graph: %s", err.Error())
+		}
+		j, err := g.GetJob("pkg0:x86_64")
+		if err != nil {
+			t.Fatalf("failed to get job: %s", err.Error())
+		}
+
+		// populate cache as if the job had been run
+		_, err = j.ShouldRun()
+		if err != nil {
+			t.Fatalf("failed to check job: %s", err.Error())
+		}
+		err = cache.Update(j.(*job).info)
+		if err != nil {
+			t.Fatalf("failed to update cache: %s", err.Error())
+		}
+
+		run, err := j.ShouldRun()
+		if err != nil {
+			t.Fatalf("failed to check job: %s", err.Error())
+		}
+		if run != force {
+			t.Errorf("expected ShouldRun to be %v with ForceRebuild=%v", force, force)
+		}
+	}
+}
+
+func TestGraphCross(t *testing.T) {
+	rpi := testDepIndex(4)
+	for _, ent := range rpi {
+		ent.Pkgen.Version = "1.0"
+		ent.Pkgen.Arch = pkgen.ArchSet{pkgen.ArchAll}
+		ent.Pkgen.Script = []string{"true"}
+		ent.Pkgen.Cross = true
+		for _, p := range ent.Pkgen.Packages {
+			ent.Pkgen.BuildDependencies = p.Dependencies
+		}
+	}
+	rpi["pkg1"].Pkgen.Cross = false
+	fs := mapfs.New(map[string]string{})
+	g, err := Graph(rpi, GraphOptions{
+		Options: Options{
+			Loader:       pkgen.FileLoader(fs),
+			Dependencies: rpi,
+		},
+		Arch:       pkgen.Archx86_64,
+		BuildArch:  pkgen.Archaarch64,
+		SourceTree: fs,
+	})
+	if err != nil {
+		t.Fatalf("failed to create graph: %s", err.Error())
+	}
+
+	// non-cross pkgens are excluded
+	all, err := g.GetJob("all")
+	if err != nil {
+		t.Fatalf("failed to get job: %s", err.Error())
+	}
+	rules, err := all.Dependencies()
+	if err != nil {
+		t.Fatalf("failed to get rules: %s", err.Error())
+	}
+	if expect := []string{"pkg0:aarch64", "pkg2:aarch64", "pkg3:aarch64"}; !reflect.DeepEqual(rules, expect) {
+		t.Errorf("expected rules %v but got %v", expect, rules)
+	}
+
+	// cross jobs are built for the build arch
+	j, err := g.GetJob("pkg0:aarch64")
+	if err != nil {
+		t.Fatalf("failed to get job: %s", err.Error())
+	}
+	if pg := j.(*job).pkg; pg.HostArch != pkgen.Archx86_64 || pg.BuildArch != pkgen.Archaarch64 {
+		t.Errorf("unexpected arches %s->%s", pg.HostArch, pg.BuildArch)
+	}
+
+	// build dependencies are host arch packages, so they are not graph jobs
+	j, err = g.GetJob("pkg2:aarch64")
+	if err != nil {
+		t.Fatalf("failed to get job: %s", err.Error())
+	}
+	deps, err := j.Dependencies()
+	if err != nil {
+		t.Fatalf("failed to get dependencies: %s", err.Error())
+	}
+	if len(deps) != 0 {
+		t.Errorf("expected no dependencies but got %v", deps)
+	}
+	if arch := buildDepArch(j.(*job).pkg); arch != pkgen.Archx86_64 {
+		t.Errorf("expected build dependencies for x86_64 but got %s", arch)
+	}
+}
+
+func TestGraphExcludedDependency(t *testing.T) {
+	rpi := testDepIndex(3)
+	for _, ent := range rpi {
+		ent.Pkgen.Version = "1.0"
+		ent.Pkgen.Arch = pkgen.ArchSet{pkgen.ArchAll}
+		ent.Pkgen.Script = []string{"true"}
+		for _, p := range ent.Pkgen.Packages {
+			ent.Pkgen.BuildDependencies = p.Dependencies
+		}
+	}
+	// pkg2 depends on pkg1
+	rpi["pkg1"].Pkgen.Arch = pkgen.ArchSet{pkgen.Archx86_64}
+	fs := mapfs.New(map[string]string{})
+	g, err := Graph(rpi, GraphOptions{
+		Options: Options{
+			Loader:       pkgen.FileLoader(fs),
+			Dependencies: rpi,
+		},
+		Arch:       pkgen.Archaarch64,
+		SourceTree: fs,
+	})
+	if err != nil {
+		t.Fatalf("failed to create graph: %s", err.Error())
+	}
+	j, err := g.GetJob("pkg2:aarch64")
+	if err != nil {
+		t.Fatalf("failed to get job: %s", err.Error())
+	}
+	_, err = j.Dependencies()
+	if err == nil || !strings.Contains(err.Error(), `"pkg1:aarch64"`) || !strings.Contains(err.Error(), "does not support aarch64") {
+		t.Errorf("expected error naming pkg1 but got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+// httpStore is a PackageStore which stores packages on an HTTP server.
+type httpStore struct {
+	cli  *http.Client
+	base string
+}
+
+// ErrUnknownLength is an error indicating that the server did not provide the length of a package.
+var ErrUnknownLength = errors.New("package length unknown")
+
+// url gets the URL of a package.
+func (hs httpStore) url(name string, arch pkgen.Arch) string {
+	return hs.base + "/" + name + "-" + arch.String() + ".tar.gz"
+}
+
+func (hs httpStore) Store(name string, arch pkgen.Arch, body io.Reader) error {
+	req, err := http.NewRequest(http.MethodPut, hs.url(name, arch), body)
+	if err != nil {
+		return err
+	}
+	resp, err := hs.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to store package %s-%s: %s", name, arch, resp.Status)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+func (hs httpStore) GetPkg(name string, arch pkgen.Arch) (io.ReadCloser, int64, error) {
+	// check arch validity
+	if !arch.Supported() {
+		return nil, -1, pkgen.ErrUnsupportedArch
+	}
+
+	resp, err := hs.cli.Get(hs.url(name, arch))
+	if err != nil {
+		return nil, -1, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, -1, fmt.Errorf("failed to get package %s-%s: %s", name, arch, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, -1, ErrUnknownLength
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// HTTPPackageStore creates a PackageStore which stores packages on an HTTP server.
+// The URL of a package is <base>/<name>-<arch>.tar.gz.
+// Packages are stored with PUT and retrieved with GET.
+// The server must provide a Content-Length when retrieving packages.
+// If client is nil, http.DefaultClient will be used.
+func HTTPPackageStore(client *http.Client, base string) PackageStore {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return httpStore{
+		cli:  client,
+		base: strings.TrimSuffix(base, "/"),
+	}
+}
@@ -0,0 +1,76 @@
+package build
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+// testPackageServer is an in-memory HTTP package server.
+type testPackageServer struct {
+	lck  sync.Mutex
+	pkgs map[string][]byte
+}
+
+func (ps *testPackageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ps.lck.Lock()
+	defer ps.lck.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		dat, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ps.pkgs[r.URL.Path] = dat
+	case http.MethodGet:
+		dat, ok := ps.pkgs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(dat)))
+		w.Write(dat)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHTTPPackageStore(t *testing.T) {
+	ps := &testPackageServer{pkgs: map[string][]byte{}}
+	srv := httptest.NewServer(ps)
+	defer srv.Close()
+	hs := HTTPPackageStore(srv.Client(), srv.URL+"/pkgs/")
+
+	err := hs.Store("example", pkgen.Archx86_64, strings.NewReader("content"))
+	if err != nil {
+		t.Fatalf("failed to store package: %s", err.Error())
+	}
+	if _, ok := ps.pkgs["/pkgs/example-x86_64.tar.gz"]; !ok {
+		t.Errorf("package not stored at expected path")
+	}
+
+	rc, n, err := hs.GetPkg("example", pkgen.Archx86_64)
+	if err != nil {
+		t.Fatalf("failed to get package: %s", err.Error())
+	}
+	dat, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("failed to read package: %s", err.Error())
+	}
+	if string(dat) != "content" || n != int64(len("content")) {
+		t.Errorf("unexpected package content %q (%d bytes)", string(dat), n)
+	}
+
+	_, _, err = hs.GetPkg("missing", pkgen.Archx86_64)
+	if err == nil {
+		t.Error("expected error getting missing package")
+	}
+}
@@ -0,0 +1,105 @@
+package build
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// ignoreFile is the name of the file listing paths to skip when indexing.
+const ignoreFile = ".pkgenignore"
+
+// ignorePattern is a pattern from a .pkgenignore file.
+type ignorePattern struct {
+	// glob is the path.Match pattern
+	glob string
+
+	// anchored is whether the pattern matches the full path from the root
+	// otherwise, it matches the name of any file or directory
+	anchored bool
+
+	// dirOnly is whether the pattern only matches directories
+	dirOnly bool
+}
+
+// ignoreList is a list of patterns from a .pkgenignore file.
+//
+// The format is a simplified version of .gitignore:
+//
+//	# comments and blank lines are skipped
+//	examples/        a trailing slash only matches directories
+//	test-*           patterns without a slash match names at any depth
+//	/extra/broken    patterns with a slash match paths from the root
+//
+// Patterns use the syntax of path.Match.
+type ignoreList []ignorePattern
+
+// match checks whether a slash-separated path relative to the root is ignored.
+func (il ignoreList) match(p string, dir bool) bool {
+	p = strings.TrimPrefix(path.Clean(p), "./")
+	for _, v := range il {
+		if v.dirOnly && !dir {
+			continue
+		}
+		target := path.Base(p)
+		if v.anchored {
+			target = p
+		}
+		if ok, _ := path.Match(v.glob, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIgnore parses a .pkgenignore file.
+func parseIgnore(sc *bufio.Scanner) (ignoreList, error) {
+	il := ignoreList{}
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var pat ignorePattern
+		if strings.HasSuffix(line, "/") {
+			pat.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			pat.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", line, err.Error())
+		}
+		pat.glob = line
+		il = append(il, pat)
+	}
+	err := sc.Err()
+	if err != nil {
+		return nil, err
+	}
+	return il, nil
+}
+
+// loadIgnore loads the .pkgenignore file from the root of a VFS.
+// If there is no .pkgenignore file, an empty list is returned.
+func loadIgnore(fs vfs.FileSystem) (ignoreList, error) {
+	f, err := fs.Open(ignoreFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ignoreList{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	il, err := parseIgnore(bufio.NewScanner(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ignoreFile, err.Error())
+	}
+	return il, nil
+}
@@ -0,0 +1,67 @@
+package build
+
+import (
+	"encoding/json"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+// KVStore is a key-value store which can be used as a BuildCache with KVCache.
+// This can be implemented by a shared store (such as Redis), so that multiple builders share cache state.
+// Implementations must be safe for concurrent use.
+type KVStore interface {
+	// Get gets the value of a key.
+	// The bool is false if the key is not present.
+	Get(key string) ([]byte, bool, error)
+
+	// Set sets the value of a key.
+	Set(key string, val []byte) error
+}
+
+// kvCache is a BuildCache backed by a KVStore.
+type kvCache struct {
+	kv     KVStore
+	prefix string
+}
+
+func (kc kvCache) key(name string, arch pkgen.Arch) string {
+	return kc.prefix + name + "-" + arch.String()
+}
+
+func (kc kvCache) Lookup(name string, arch pkgen.Arch) (Info, bool, error) {
+	dat, ok, err := kc.kv.Get(kc.key(name, arch))
+	if err != nil || !ok {
+		return Info{}, false, err
+	}
+	var info Info
+	err = json.Unmarshal(dat, &info)
+	if err != nil {
+		return Info{}, false, err
+	}
+	return info, true, nil
+}
+
+func (kc kvCache) Valid(info Info) (bool, error) {
+	cinfo, ok, err := kc.Lookup(info.PackageName, info.Arch)
+	if err != nil || !ok {
+		return false, err
+	}
+	return info.Hash == cinfo.Hash, nil
+}
+
+func (kc kvCache) Update(info Info) error {
+	dat, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return kc.kv.Set(kc.key(info.PackageName, info.Arch), dat)
+}
+
+// KVCache creates a BuildCache which stores JSON-encoded build Info in a KVStore.
+// Keys are in the format <prefix><name>-<arch>.
+func KVCache(kv KVStore, prefix string) BuildCache {
+	return kvCache{
+		kv:     kv,
+		prefix: prefix,
+	}
+}
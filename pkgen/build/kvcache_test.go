@@ -0,0 +1,82 @@
+package build
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+// mapKV is an in-process KVStore.
+type mapKV struct {
+	lck sync.Mutex
+	m   map[string][]byte
+}
+
+func (mkv *mapKV) Get(key string) ([]byte, bool, error) {
+	mkv.lck.Lock()
+	defer mkv.lck.Unlock()
+	v, ok := mkv.m[key]
+	return v, ok, nil
+}
+
+func (mkv *mapKV) Set(key string, val []byte) error {
+	mkv.lck.Lock()
+	defer mkv.lck.Unlock()
+	mkv.m[key] = val
+	return nil
+}
+
+func TestKVCache(t *testing.T) {
+	kv := &mapKV{m: map[string][]byte{}}
+	kc := KVCache(kv, "panux/")
+	info := Info{PackageName: "example", Arch: pkgen.Archx86_64, Hash: [32]byte{1}}
+
+	ok, err := kc.Valid(info)
+	if err != nil || ok {
+		t.Errorf("expected missing entry to be invalid (err: %v)", err)
+	}
+	err = kc.Update(info)
+	if err != nil {
+		t.Fatalf("failed to update cache: %s", err.Error())
+	}
+	if _, ok := kv.m["panux/example-x86_64"]; !ok {
+		t.Error("entry not stored under expected key")
+	}
+	ok, err = kc.Valid(info)
+	if err != nil || !ok {
+		t.Errorf("expected entry to be valid (err: %v)", err)
+	}
+	info.Hash[0] = 2
+	ok, err = kc.Valid(info)
+	if err != nil || ok {
+		t.Errorf("expected changed hash to be invalid (err: %v)", err)
+	}
+}
+
+func TestKVCacheConcurrent(t *testing.T) {
+	kc := KVCache(&mapKV{m: map[string][]byte{}}, "")
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			info := Info{
+				PackageName: fmt.Sprintf("pkg%d", i%4),
+				Arch:        pkgen.Archx86_64,
+				Hash:        [32]byte{byte(i % 4)},
+			}
+			err := kc.Update(info)
+			if err != nil {
+				t.Errorf("failed to update cache: %s", err.Error())
+				return
+			}
+			ok, err := kc.Valid(info)
+			if err != nil || !ok {
+				t.Errorf("expected %q to be valid (err: %v)", info.PackageName, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,51 @@
+package build
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/tools/godoc/vfs"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+// memFS is an in-memory vfs.FileSystem.
+// It wraps a mapfs, resolving paths relative to the root (such as ".") as IndexDir uses them.
+type memFS struct {
+	vfs.FileSystem
+}
+
+// abs converts a path to a clean absolute path.
+func (memFS) abs(p string) string {
+	return path.Clean("/" + p)
+}
+
+func (m memFS) Open(p string) (vfs.ReadSeekCloser, error) {
+	return m.FileSystem.Open(m.abs(p))
+}
+
+func (m memFS) Lstat(p string) (os.FileInfo, error) {
+	return m.FileSystem.Lstat(m.abs(p))
+}
+
+func (m memFS) Stat(p string) (os.FileInfo, error) {
+	return m.FileSystem.Stat(m.abs(p))
+}
+
+func (m memFS) ReadDir(p string) ([]os.FileInfo, error) {
+	return m.FileSystem.ReadDir(m.abs(p))
+}
+
+// MemFS creates an in-memory vfs.FileSystem from a map of slash-separated paths to file contents.
+// This can be used with IndexDir to index pkgens without touching the disk:
+//
+//	IndexDir(MemFS(map[string]string{
+//		"example/pkgen.yaml": "...",
+//	}))
+func MemFS(files map[string]string) vfs.FileSystem {
+	m := make(map[string]string, len(files))
+	for p, v := range files {
+		m[strings.TrimPrefix(path.Clean("/"+p), "/")] = v
+	}
+	return memFS{mapfs.New(m)}
+}
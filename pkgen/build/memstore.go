@@ -0,0 +1,59 @@
+package build
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+// memStore is a PackageStore which stores packages in memory.
+type memStore struct {
+	lck  sync.RWMutex
+	pkgs map[string][]byte
+}
+
+func (ms *memStore) Store(name string, arch pkgen.Arch, body io.Reader) error {
+	dat, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	ms.lck.Lock()
+	defer ms.lck.Unlock()
+	ms.pkgs[name+"-"+arch.String()] = dat
+
+	return nil
+}
+
+func (ms *memStore) GetPkg(name string, arch pkgen.Arch) (io.ReadCloser, int64, error) {
+	// check arch validity
+	if !arch.Supported() {
+		return nil, -1, pkgen.ErrUnsupportedArch
+	}
+
+	ms.lck.RLock()
+	defer ms.lck.RUnlock()
+	key := name + "-" + arch.String()
+	dat, ok := ms.pkgs[key]
+	if !ok {
+		return nil, -1, &os.PathError{
+			Op:   "open",
+			Path: key + ".tar.gz",
+			Err:  os.ErrNotExist,
+		}
+	}
+
+	// stored data is never modified, so it can be read without copying
+	return ioutil.NopCloser(bytes.NewReader(dat)), int64(len(dat)), nil
+}
+
+// MemStore creates a PackageStore which stores packages in memory.
+// If a package is not found, GetPkg returns an error satisfying os.IsNotExist.
+// The PackageStore is safe for concurrent use.
+func MemStore() PackageStore {
+	return &memStore{pkgs: map[string][]byte{}}
+}
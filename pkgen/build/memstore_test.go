@@ -0,0 +1,65 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+func TestMemStore(t *testing.T) {
+	ms := MemStore()
+	err := ms.Store("example", pkgen.Archx86_64, strings.NewReader("content"))
+	if err != nil {
+		t.Fatalf("failed to store package: %s", err.Error())
+	}
+	rc, n, err := ms.GetPkg("example", pkgen.Archx86_64)
+	if err != nil {
+		t.Fatalf("failed to get package: %s", err.Error())
+	}
+	dat, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("failed to read package: %s", err.Error())
+	}
+	if string(dat) != "content" || n != int64(len("content")) {
+		t.Errorf("unexpected package content %q (%d bytes)", string(dat), n)
+	}
+
+	_, _, err = ms.GetPkg("example", pkgen.Archx86)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected not exist error but got %v", err)
+	}
+}
+
+func TestMemStoreConcurrent(t *testing.T) {
+	ms := MemStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("pkg%d", i%4)
+			err := ms.Store(name, pkgen.Archx86_64, strings.NewReader(name))
+			if err != nil {
+				t.Errorf("failed to store package: %s", err.Error())
+				return
+			}
+			rc, _, err := ms.GetPkg(name, pkgen.Archx86_64)
+			if err != nil {
+				t.Errorf("failed to get package: %s", err.Error())
+				return
+			}
+			dat, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil || string(dat) != name {
+				t.Errorf("bad content for %q", name)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
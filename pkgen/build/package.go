@@ -1,10 +1,16 @@
 package build
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"gitlab.com/panux/builder/pkgen"
 )
@@ -12,7 +18,7 @@ import (
 // OutputHandler is an interface to handle the output of builds.
 type OutputHandler interface {
 	// Store stores the output of a build to an external location.
-	// The body is in tar format, containing the packages with path in relative format (./example.tar.gz).
+	// The body is a single package in gzip format.
 	Store(name string, arch pkgen.Arch, body io.Reader) error
 }
 
@@ -31,6 +37,21 @@ type PackageStore interface {
 
 type dirStore struct {
 	dir string
+
+	// verify is whether to verify packages against their checksum files in GetPkg
+	verify bool
+
+	// format is the format used to store packages
+	// if empty, packages are not converted and FormatGzip is assumed
+	format PackageFormat
+}
+
+// pkgFormat gets the format used to store packages.
+func (ds dirStore) pkgFormat() PackageFormat {
+	if ds.format == "" {
+		return FormatGzip
+	}
+	return ds.format
 }
 
 func (ds dirStore) writeFile(name string, src io.Reader) (err error) {
@@ -38,7 +59,7 @@ func (ds dirStore) writeFile(name string, src io.Reader) (err error) {
 	path := filepath.Join(ds.dir, name)
 
 	// open file
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
@@ -59,23 +80,74 @@ func (ds dirStore) writeFile(name string, src io.Reader) (err error) {
 }
 
 func (ds dirStore) Store(name string, arch pkgen.Arch, body io.Reader) (err error) {
-	f, err := os.OpenFile(filepath.Join(ds.dir, name+"-"+arch.String()+".tar.gz"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	// convert package to store format
+	// if no format was configured, the package is stored as-is
+	format := ds.pkgFormat()
+	if ds.format != "" {
+		r, err := convertFormat(body, format)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		body = r
+	}
+
+	fname := name + "-" + arch.String() + format.Ext()
+	sum, err := ds.storeFile(fname, body)
+	if err != nil {
+		return err
+	}
+
+	// write checksum file (in sha256sum format)
+	err = ds.writeFile(fname+".sha256", strings.NewReader(fmt.Sprintf("%x  %s\n", sum, fname)))
 	if err != nil {
 		return err
 	}
+
+	return nil
+}
+
+// storeFile stores a package file and returns its SHA256 hash.
+func (ds dirStore) storeFile(fname string, body io.Reader) (sum []byte, err error) {
+	f, err := os.OpenFile(filepath.Join(ds.dir, fname), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
 	defer func() {
 		cerr := f.Close()
 		if cerr != nil && err == nil {
 			err = cerr
+			sum = nil
 		}
 	}()
 
-	_, err = io.Copy(f, body)
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return h.Sum(nil), nil
+}
+
+// readSum reads the hash from the checksum file of a package.
+func (ds dirStore) readSum(fname string) ([]byte, error) {
+	dat, err := ioutil.ReadFile(filepath.Join(ds.dir, fname+".sha256"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("missing checksum for %q", fname)
+		}
+		return nil, err
+	}
+	fields := strings.Fields(string(dat))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid checksum file for %q", fname)
+	}
+	sum, err := hex.DecodeString(fields[0])
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid checksum file for %q", fname)
+	}
+	return sum, nil
 }
 
 func (ds dirStore) GetPkg(name string, arch pkgen.Arch) (io.ReadCloser, int64, error) {
@@ -84,11 +156,14 @@ func (ds dirStore) GetPkg(name string, arch pkgen.Arch) (io.ReadCloser, int64, e
 		return nil, -1, pkgen.ErrUnsupportedArch
 	}
 
-	// generate path
-	path := filepath.Join(ds.dir, name+"-"+arch.String()+".tar.gz")
-
 	// get file
-	f, err := os.Open(path)
+	// packages stored in gzip format are supported for compatibility
+	fname := name + "-" + arch.String() + ds.pkgFormat().Ext()
+	f, err := os.Open(filepath.Join(ds.dir, fname))
+	if os.IsNotExist(err) && ds.pkgFormat() != FormatGzip {
+		fname = name + "-" + arch.String() + FormatGzip.Ext()
+		f, err = os.Open(filepath.Join(ds.dir, fname))
+	}
 	if err != nil {
 		return nil, -1, err
 	}
@@ -100,12 +175,55 @@ func (ds dirStore) GetPkg(name string, arch pkgen.Arch) (io.ReadCloser, int64, e
 		return nil, -1, err
 	}
 
+	// verify checksum
+	if ds.verify {
+		sum, err := ds.readSum(fname)
+		if err != nil {
+			f.Close()
+			return nil, -1, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		if err != nil {
+			f.Close()
+			return nil, -1, err
+		}
+		if !bytes.Equal(h.Sum(nil), sum) {
+			f.Close()
+			return nil, -1, ErrPackageCorrupt
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			f.Close()
+			return nil, -1, err
+		}
+	}
+
 	return f, info.Size(), nil
 }
 
+// DirStoreOptions is a set of options for a DirStore.
+type DirStoreOptions struct {
+	// Verify is whether to verify packages against their checksum files in GetPkg.
+	// If a package does not match its checksum, GetPkg returns ErrPackageCorrupt.
+	// Packages without a checksum file cannot be retrieved.
+	Verify bool
+
+	// Format is the format used to store packages.
+	// Packages are converted to the format when they are stored.
+	// Packages previously stored in gzip format can still be retrieved.
+	// Optional - defaults to FormatGzip.
+	Format PackageFormat
+}
+
 // DirStore creates a PackageStore which stores packages in a directory.
-func DirStore(dir string) PackageStore {
-	return &dirStore{dir: dir}
+// A checksum file (e.g. <package>.tar.gz.sha256) is stored alongside each package.
+func DirStore(dir string, opts DirStoreOptions) PackageStore {
+	return &dirStore{
+		dir:    dir,
+		verify: opts.Verify,
+		format: opts.Format,
+	}
 }
 
 // Info is a struct containing identifying information for the build.
@@ -118,6 +236,10 @@ type Info struct {
 
 	// Hash is the SHA256 hash of the build inputs.
 	Hash [sha256.Size]byte `json:"hash"`
+
+	// Inputs are the hashes of the individual build inputs.
+	// Optional - used to find the reasons for a rebuild.
+	Inputs []InputHash `json:"inputs,omitempty"`
 }
 
 // BuildDepsDocker finds build deps not provided by docker.
@@ -128,19 +250,22 @@ func BuildDepsDocker(pkg *pkgen.PackageGenerator, deps DependencyFinder, img Ima
 	}
 
 	d2 := []string{}
+dloop:
 	for _, v := range d {
 		for _, p := range img.Packages {
 			if v == p {
-				continue
+				continue dloop
 			}
-
-			d2 = append(d, v)
 		}
+
+		d2 = append(d2, v)
 	}
 
 	return d2, nil
 }
 
+// mapRuleDeps maps package dependencies to the names of the graph jobs which build them.
+// The result is sorted.
 func mapRuleDeps(rpi RawPackageIndex, arch pkgen.Arch, deps ...string) []string {
 	rdeps := map[string]struct{}{}
 	for _, d := range deps {
@@ -150,8 +275,10 @@ func mapRuleDeps(rpi RawPackageIndex, arch pkgen.Arch, deps ...string) []string
 	res := make([]string, len(rdeps))
 	i := 0
 	for d := range rdeps {
-		res[i] = d + "-" + arch.String()
+		res[i] = d + ":" + arch.String()
+		i++
 	}
+	sort.Strings(res)
 
 	return res
 }
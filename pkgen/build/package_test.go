@@ -0,0 +1,64 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/panux/builder/pkgen"
+)
+
+func TestVerifiedDirStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirstore")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	ds := DirStore(dir, DirStoreOptions{Verify: true})
+
+	err = ds.Store("example", pkgen.Archx86_64, strings.NewReader("content"))
+	if err != nil {
+		t.Fatalf("failed to store package: %s", err.Error())
+	}
+	rc, n, err := ds.GetPkg("example", pkgen.Archx86_64)
+	if err != nil {
+		t.Fatalf("failed to get package: %s", err.Error())
+	}
+	dat, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("failed to read package: %s", err.Error())
+	}
+	if string(dat) != "content" || n != int64(len("content")) {
+		t.Errorf("unexpected package content %q (%d bytes)", string(dat), n)
+	}
+
+	// corrupt package
+	err = ioutil.WriteFile(filepath.Join(dir, "example-x86_64.tar.gz"), []byte("corrupted"), 0644)
+	if err != nil {
+		t.Fatalf("failed to corrupt package: %s", err.Error())
+	}
+	_, _, err = ds.GetPkg("example", pkgen.Archx86_64)
+	if err != ErrPackageCorrupt {
+		t.Errorf("expected ErrPackageCorrupt but got %v", err)
+	}
+
+	// unverified store does not check
+	rc, _, err = DirStore(dir, DirStoreOptions{}).GetPkg("example", pkgen.Archx86_64)
+	if err != nil {
+		t.Fatalf("failed to get package: %s", err.Error())
+	}
+	rc.Close()
+
+	// missing checksum
+	err = os.Remove(filepath.Join(dir, "example-x86_64.tar.gz.sha256"))
+	if err != nil {
+		t.Fatalf("failed to remove checksum: %s", err.Error())
+	}
+	_, _, err = ds.GetPkg("example", pkgen.Archx86_64)
+	if err == nil {
+		t.Error("expected error for missing checksum")
+	}
+}
@@ -22,6 +22,22 @@ func (err ErrPkgNotFound) String() string {
 	return err.Error()
 }
 
+// ErrInvalidPkgen is an error type indicating that a pkgen could not be loaded.
+type ErrInvalidPkgen struct {
+	// Path is the path of the pkgen.
+	Path string
+
+	// Err is the error which occurred while loading the pkgen.
+	Err error
+}
+
+func (err ErrInvalidPkgen) Error() string {
+	return fmt.Sprintf("pkgen %q: %s", err.Path, err.Err.Error())
+}
+func (err ErrInvalidPkgen) String() string {
+	return err.Error()
+}
+
 // RawPackageIndex is an in-memory index of packages.
 type RawPackageIndex map[string]*RawPkent
 
@@ -48,6 +64,44 @@ func (rpi RawPackageIndex) FindDependencies(pkgs ...string) ([]string, error) {
 	return DepWalker(rpi.DepWalker).Walk(pkgs...)
 }
 
+// BuildDepWalker is a DepWalker function which walks the build dependencies of pkgens.
+// The dependencies of a pkgen are the other pkgens providing its build dependencies (including their dependencies).
+func (rpi RawPackageIndex) BuildDepWalker(name string) ([]string, error) {
+	// lookup pkgen in index
+	ent, ok := rpi[name]
+	if !ok {
+		return nil, ErrPkgNotFound{name}
+	}
+
+	// find build dependencies
+	deps, err := rpi.FindDependencies(ent.Pkgen.BuildDependencies...)
+	if err != nil {
+		return nil, err
+	}
+
+	// map packages to pkgens
+	dset := map[string]struct{}{}
+	for _, d := range deps {
+		if dn := filepath.Base(filepath.Dir(rpi[d].Path)); dn != name {
+			dset[dn] = struct{}{}
+		}
+	}
+	res := make([]string, 0, len(dset))
+	for d := range dset {
+		res = append(res, d)
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
+// CheckBuildCycles checks for cycles in the build dependencies of the pkgens, which would make it impossible to order the builds.
+// If a cycle is found, an ErrDependencyCycle listing the pkgens is returned.
+// Cycles in runtime dependencies are allowed.
+func (rpi RawPackageIndex) CheckBuildCycles() error {
+	return DepWalker(rpi.BuildDepWalker).CheckCycles(rpi.List()...)
+}
+
 // List gets a list of packages.
 func (rpi RawPackageIndex) List() []string {
 	// get name list
@@ -102,9 +156,24 @@ func loadEnt(fs vfs.FileSystem, path string) (ent *RawPkent, err error) {
 	}, nil
 }
 
+// indexOptions are options for indexVFS.
+type indexOptions struct {
+	// errs is a list of pkgen load errors
+	// if nil, a load error aborts the index
+	errs *[]ErrInvalidPkgen
+
+	// ignore is a list of ignore patterns
+	ignore ignoreList
+}
+
 // indexVFS recurses through a VFS and adds all pkgen.yaml files to the RawPackageIndex.
 // The top level call should pass in nil for info.
-func indexVFS(fs vfs.FileSystem, path string, info os.FileInfo, rpi RawPackageIndex) error {
+func indexVFS(fs vfs.FileSystem, path string, info os.FileInfo, rpi RawPackageIndex, opts *indexOptions) error {
+	if info != nil && opts.ignore.match(filepath.ToSlash(path), info.IsDir()) {
+		// ignored by .pkgenignore
+		return nil
+	}
+
 	switch {
 	case info == nil:
 		// top level
@@ -116,7 +185,7 @@ func indexVFS(fs vfs.FileSystem, path string, info os.FileInfo, rpi RawPackageIn
 			return err
 		}
 		for _, f := range files {
-			err = indexVFS(fs, filepath.Join(path, f.Name()), f, rpi)
+			err = indexVFS(fs, filepath.Join(path, f.Name()), f, rpi, opts)
 			if err != nil {
 				return err
 			}
@@ -125,7 +194,15 @@ func indexVFS(fs vfs.FileSystem, path string, info os.FileInfo, rpi RawPackageIn
 		// load pkgen
 		ent, err := loadEnt(fs, path)
 		if err != nil {
-			return err
+			ierr := ErrInvalidPkgen{
+				Path: path,
+				Err:  err,
+			}
+			if opts.errs == nil {
+				return ierr
+			}
+			*opts.errs = append(*opts.errs, ierr)
+			return nil
 		}
 
 		// add entry to index
@@ -136,15 +213,48 @@ func indexVFS(fs vfs.FileSystem, path string, info os.FileInfo, rpi RawPackageIn
 }
 
 // IndexDir finds all pkgens in a dir and uses them to make a RawPackageIndex.
+// Paths matching patterns in a .pkgenignore file at the root of the dir are skipped.
 func IndexDir(dir vfs.FileSystem) (RawPackageIndex, error) {
+	// load ignore list
+	ign, err := loadIgnore(dir)
+	if err != nil {
+		return nil, err
+	}
+
 	// create index
 	rpi := make(RawPackageIndex)
 
 	// recurse through dir
-	err := indexVFS(dir, ".", nil, rpi)
+	err = indexVFS(dir, ".", nil, rpi, &indexOptions{ignore: ign})
 	if err != nil {
 		return nil, err
 	}
 
 	return rpi, nil
 }
+
+// IndexDirLenient finds all pkgens in a dir and uses them to make a RawPackageIndex, like IndexDir.
+// Unlike IndexDir, pkgens which fail to load are skipped, and returned as a list of errors.
+// The returned error is only non-nil if the dir could not be scanned.
+func IndexDirLenient(dir vfs.FileSystem) (RawPackageIndex, []ErrInvalidPkgen, error) {
+	// load ignore list
+	ign, err := loadIgnore(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// create index
+	rpi := make(RawPackageIndex)
+
+	// recurse through dir
+	errs := []ErrInvalidPkgen{}
+	err = indexVFS(dir, ".", nil, rpi, &indexOptions{
+		errs:   &errs,
+		ignore: ign,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rpi, errs, nil
+}
@@ -0,0 +1,155 @@
+package build
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIndexMemFS(t *testing.T) {
+	rpi, err := IndexDir(MemFS(map[string]string{
+		"libs/zlib/pkgen.yaml": `
+packages:
+  zlib:
+  zlib-dev:
+    dependencies: [zlib]
+version: "1.2.11"
+script: [make]
+`,
+		"tools/curl/pkgen.yaml": `
+packages:
+  curl:
+    dependencies: [zlib]
+builddependencies: [zlib-dev]
+version: "7.60.0"
+script: [make]
+`,
+		"tools/curl/README": "not a pkgen",
+	}))
+	if err != nil {
+		t.Fatalf("failed to index: %s", err.Error())
+	}
+	if expect := []string{"curl", "zlib"}; !reflect.DeepEqual(rpi.List(), expect) {
+		t.Errorf("expected %v but got %v", expect, rpi.List())
+	}
+	deps, err := rpi.FindDependencies("curl")
+	if err != nil {
+		t.Fatalf("failed to find dependencies: %s", err.Error())
+	}
+	if expect := []string{"zlib", "curl"}; !reflect.DeepEqual(deps, expect) {
+		t.Errorf("expected %v but got %v", expect, deps)
+	}
+	deps, err = rpi.FindDependencies(rpi["curl"].Pkgen.BuildDependencies...)
+	if err != nil {
+		t.Fatalf("failed to find dependencies: %s", err.Error())
+	}
+	if expect := []string{"zlib", "zlib-dev"}; !reflect.DeepEqual(deps, expect) {
+		t.Errorf("expected %v but got %v", expect, deps)
+	}
+}
+
+func TestIndexDirLenient(t *testing.T) {
+	fs := MemFS(map[string]string{
+		"good/pkgen.yaml": `
+packages:
+  good:
+version: "1.0"
+script: [make]
+`,
+		"bad/pkgen.yaml":     "packages: [\n",
+		"badarch/pkgen.yaml": "arch: [pdp11]\n",
+	})
+
+	// strict mode aborts
+	_, err := IndexDir(fs)
+	if _, ok := err.(ErrInvalidPkgen); !ok {
+		t.Errorf("expected ErrInvalidPkgen but got %v", err)
+	}
+
+	// lenient mode skips invalid pkgens
+	rpi, errs, err := IndexDirLenient(fs)
+	if err != nil {
+		t.Fatalf("failed to index: %s", err.Error())
+	}
+	if expect := []string{"good"}; !reflect.DeepEqual(rpi.List(), expect) {
+		t.Errorf("expected %v but got %v", expect, rpi.List())
+	}
+	paths := []string{}
+	for _, v := range errs {
+		paths = append(paths, v.Path)
+	}
+	if expect := []string{"bad/pkgen.yaml", "badarch/pkgen.yaml"}; !reflect.DeepEqual(paths, expect) {
+		t.Errorf("expected errors for %v but got %v", expect, errs)
+	}
+}
+
+func TestIndexDirIgnore(t *testing.T) {
+	pkgen := func(name string) string {
+		return "packages:\n  " + name + ":\nversion: \"1.0\"\nscript: [make]\n"
+	}
+	rpi, err := IndexDir(MemFS(map[string]string{
+		".pkgenignore": `
+# examples are not built
+examples/
+test-*
+/extra/broken
+`,
+		"core/zlib/pkgen.yaml":         pkgen("zlib"),
+		"examples/hello/pkgen.yaml":    pkgen("hello"),
+		"core/test-pkg/pkgen.yaml":     pkgen("test-pkg"),
+		"extra/broken/pkgen.yaml":      "packages: [\n",
+		"extra/curl/pkgen.yaml":        pkgen("curl"),
+		"extra/curl/broken/pkgen.yaml": pkgen("curl-broken"),
+	}))
+	if err != nil {
+		t.Fatalf("failed to index: %s", err.Error())
+	}
+	// anchored patterns only match from the root, so extra/curl/broken is kept
+	if expect := []string{"broken", "curl", "zlib"}; !reflect.DeepEqual(rpi.List(), expect) {
+		t.Errorf("expected %v but got %v", expect, rpi.List())
+	}
+}
+
+func TestCheckBuildCycles(t *testing.T) {
+	pkgen := func(pkg string, deps string, builddeps string) string {
+		return "packages:\n  " + pkg + ":\n    dependencies: [" + deps + "]\nbuilddependencies: [" + builddeps + "]\nversion: \"1.0\"\nscript: [make]\n"
+	}
+
+	// mutual runtime dependencies are allowed
+	rpi, err := IndexDir(MemFS(map[string]string{
+		"python/pkgen.yaml":   pkgen("python", "python-pip", ""),
+		"pip/pkgen.yaml":      pkgen("python-pip", "python", ""),
+		"example/pkgen.yaml":  pkgen("example", "python", "python"),
+		"example2/pkgen.yaml": pkgen("example2", "example", "example"),
+	}))
+	if err != nil {
+		t.Fatalf("failed to index: %s", err.Error())
+	}
+	deps, err := rpi.FindDependencies("example2")
+	if err != nil {
+		t.Fatalf("failed to find dependencies: %s", err.Error())
+	}
+	if len(deps) != 4 {
+		t.Errorf("expected 4 dependencies but got %v", deps)
+	}
+	err = rpi.CheckBuildCycles()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+
+	// build dependency cycles are reported
+	rpi, err = IndexDir(MemFS(map[string]string{
+		"gcc/pkgen.yaml":  pkgen("gcc", "", "musl"),
+		"musl/pkgen.yaml": pkgen("musl", "", "gcc"),
+	}))
+	if err != nil {
+		t.Fatalf("failed to index: %s", err.Error())
+	}
+	err = rpi.CheckBuildCycles()
+	cerr, ok := err.(ErrDependencyCycle)
+	if !ok {
+		t.Fatalf("expected ErrDependencyCycle but got %v", err)
+	}
+	if expect := []string{"gcc", "musl", "gcc"}; !reflect.DeepEqual(cerr.Packages, expect) {
+		t.Errorf("expected cycle %v but got %v", expect, cerr.Packages)
+	}
+}
@@ -1,6 +1,7 @@
 package buildlog
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -59,6 +60,38 @@ func NewJSONHandler(w io.WriteCloser) (Handler, error) {
 	}, nil
 }
 
+// maxJSONLineSize is the maximum size of a line read by JSONLineReader.
+// Build output lines can exceed the default limit of bufio.Scanner.
+const maxJSONLineSize = 16 * 1024 * 1024
+
+// JSONLineReader reads newline-delimited JSON log lines from a reader.
+// Each line is decoded as a Line and forwarded to the Handler.
+// Lines which are not valid JSON log lines are forwarded as raw text on StreamStdout.
+func JSONLineReader(h Handler, r io.Reader) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), maxJSONLineSize)
+	for s.Scan() {
+		var l Line
+		err := json.Unmarshal(s.Bytes(), &l)
+		if err != nil || !l.Stream.Valid() {
+			// fall back to raw text
+			l = Line{
+				Text:   s.Text(),
+				Stream: StreamStdout,
+			}
+		}
+		err = h.Log(l)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.Err()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 // ReadJSONStream reads a log from a JSON array.
 func ReadJSONStream(dst Handler, src io.Reader) error {
 	jd := json.NewDecoder(src)
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -60,3 +61,48 @@ func TestJSONLog(t *testing.T) {
 		t.Errorf("expected %v but got %v", logmsgs, []Line(out))
 	}
 }
+
+func TestJSONLineReader(t *testing.T) {
+	in := strings.Join([]string{
+		`{"text":"compiling","stream":3}`,
+		`plain text`,
+		`{"text":"warning","stream":2}`,
+		`{"text":"bad stream","stream":9}`,
+		`{not json`,
+	}, "\n")
+	expect := []Line{
+		{Stream: StreamBuild, Text: "compiling"},
+		{Stream: StreamStdout, Text: "plain text"},
+		{Stream: StreamStderr, Text: "warning"},
+		{Stream: StreamStdout, Text: `{"text":"bad stream","stream":9}`},
+		{Stream: StreamStdout, Text: `{not json`},
+	}
+
+	var out sliceHandler
+	err := JSONLineReader(&out, strings.NewReader(in))
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if !reflect.DeepEqual([]Line(out), expect) {
+		t.Errorf("expected %v but got %v", expect, []Line(out))
+	}
+}
+
+func TestJSONLineReaderLongLine(t *testing.T) {
+	long := strings.Repeat("x", 256*1024)
+	in := `{"text":"` + long + `","stream":3}` + "\n" + long
+
+	var out sliceHandler
+	err := JSONLineReader(&out, strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	expect := []Line{
+		{Stream: StreamBuild, Text: long},
+		{Stream: StreamStdout, Text: long},
+	}
+	if !reflect.DeepEqual([]Line(out), expect) {
+		t.Errorf("long lines not read correctly")
+	}
+}
@@ -2,8 +2,12 @@ package pkgen
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net/url"
+	"os"
+	"path"
+	"strings"
 
 	"golang.org/x/tools/godoc/vfs"
 )
@@ -15,17 +19,62 @@ type fileLoader struct {
 
 var fprotos = []string{"file"}
 
+// ErrPathEscape is an error returned by the file Loader if a source path escapes the root of the VFS.
+var ErrPathEscape = errors.New("path escapes source root")
+
 func (fl fileLoader) SupportedProtocols() ([]string, error) {
 	return fprotos, nil
 }
 
+// resolve validates the path of a file URL and converts it to a clean absolute path in the VFS.
+// Symlinks are rejected, as they may point outside of the root.
+func (fl fileLoader) resolve(u *url.URL) (string, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		// e.g. file://../x
+		return "", ErrPathEscape
+	}
+	p := u.Path
+	if u.Opaque != "" {
+		p = u.Opaque
+	}
+	if p == "" {
+		return "", ErrPathEscape
+	}
+
+	// check for ".." elements escaping the root
+	if rel := path.Clean(strings.TrimPrefix(p, "/")); rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", ErrPathEscape
+	}
+	p = path.Clean("/" + p)
+
+	// check for symlinks
+	for d := p; d != "/"; d = path.Dir(d) {
+		info, err := fl.fs.Lstat(d)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", ErrPathEscape
+		}
+	}
+
+	return p, nil
+}
+
 func (fl fileLoader) Get(ctx context.Context, u *url.URL) (int64, io.ReadCloser, error) {
+	p, err := fl.resolve(u)
+	if err != nil {
+		return -1, nil, err
+	}
 	var l int64 = -1
-	info, err := fl.fs.Stat(u.Path)
+	info, err := fl.fs.Stat(p)
 	if err == nil {
 		l = info.Size()
 	}
-	f, err := fl.fs.Open(u.Path)
+	f, err := fl.fs.Open(p)
 	if err != nil {
 		return -1, nil, err
 	}
@@ -33,6 +82,8 @@ func (fl fileLoader) Get(ctx context.Context, u *url.URL) (int64, io.ReadCloser,
 }
 
 // FileLoader returns a Loader which loads files from the given VFS.
+// Paths are resolved relative to the root of the VFS.
+// Paths which escape the root (including through symlinks) are rejected with ErrPathEscape.
 func FileLoader(fs vfs.FileSystem) Loader {
 	return fileLoader{fs: fs}
 }
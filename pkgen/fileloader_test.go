@@ -0,0 +1,89 @@
+package pkgen
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
+func TestFileLoaderEscape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileloader")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	err = os.MkdirAll(filepath.Join(root, "patches"), 0755)
+	if err != nil {
+		t.Fatalf("failed to create dir: %s", err.Error())
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "patches", "fix.patch"), []byte("patch"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err.Error())
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %s", err.Error())
+	}
+	err = os.Symlink(filepath.Join(dir, "secret"), filepath.Join(root, "link"))
+	if err != nil {
+		t.Fatalf("failed to create symlink: %s", err.Error())
+	}
+	err = os.Symlink(dir, filepath.Join(root, "dirlink"))
+	if err != nil {
+		t.Fatalf("failed to create symlink: %s", err.Error())
+	}
+	l := FileLoader(vfs.OS(root))
+
+	for _, v := range []string{
+		"file:///patches/fix.patch",
+		"file:/patches/fix.patch",
+		"file:patches/fix.patch",
+		"file:///patches/../patches/fix.patch",
+	} {
+		u, err := url.Parse(v)
+		if err != nil {
+			t.Fatalf("failed to parse URL %q: %s", v, err.Error())
+		}
+		n, rc, err := l.Get(context.Background(), u)
+		if err != nil {
+			t.Errorf("failed to load %q: %s", v, err.Error())
+			continue
+		}
+		dat, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || n != 5 || string(dat) != "patch" {
+			t.Errorf("bad content loading %q", v)
+		}
+	}
+
+	for _, v := range []string{
+		"file://../secret",
+		"file:../secret",
+		"file:///../secret",
+		"file:///patches/../../secret",
+		"file:///link",
+		"file:///dirlink/secret",
+	} {
+		u, err := url.Parse(v)
+		if err != nil {
+			t.Fatalf("failed to parse URL %q: %s", v, err.Error())
+		}
+		_, _, err = l.Get(context.Background(), u)
+		if err != ErrPathEscape {
+			t.Errorf("expected ErrPathEscape loading %q but got %v", v, err)
+		}
+	}
+
+	// absolute paths are resolved inside of the root
+	u := &url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Join(dir, "secret"))}
+	_, _, err = l.Get(context.Background(), u)
+	if err == nil {
+		t.Errorf("loaded %q from outside of the root", u.Path)
+	}
+}
@@ -2,12 +2,15 @@ package pkgen
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net/url"
 	"path/filepath"
 	"sort"
 	"strings"
 	"text/template"
+
+	"github.com/Masterminds/sprig"
 )
 
 // PackageGenerator is the preprocessed pkgen.
@@ -29,6 +32,7 @@ type PackageGenerator struct {
 	BuildArch Arch `json:"buildArch"`
 
 	// Version is the version of the package built.
+	// Format: [epoch:]version-build
 	// Required.
 	Version string `json:"version"`
 
@@ -49,7 +53,7 @@ type PackageGenerator struct {
 	Builder Builder `json:"builder"`
 
 	// Cross is whether or not the package may be cross compiled.
-	// Not supported. Reserved for future use.
+	// If HostArch code cannot run BuildArch code, this must be true.
 	Cross bool `json:"cross,omitempty"`
 
 	// NoBootstrap is an option to force-unbootstrap a dependency.
@@ -57,8 +61,49 @@ type PackageGenerator struct {
 	NoBootstrap map[string]bool `json:"nobootstrap"`
 }
 
+// sprigFuncs is the set of sprig functions available in templates.
+// Only functions with repeatable results and no access to the host are included, so that preprocessing is deterministic.
+var sprigFuncs = func() template.FuncMap {
+	fnm := sprig.HermeticTxtFuncMap()
+	// not removed by HermeticTxtFuncMap, but random
+	for _, name := range []string{"shuffle", "genPrivateKey", "genCA", "genSelfSignedCert", "genSignedCert", "encryptAES"} {
+		delete(fnm, name)
+	}
+	return fnm
+}()
+
+// ErrCrossUnsupported is an error returned by Preprocess when a cross build is requested for a pkgen which does not support cross compilation.
+var ErrCrossUnsupported = errors.New("pkgen does not support cross compilation")
+
+// IsCross checks whether building on hostarch for buildarch is a cross build.
+// Building for an Arch which runs on the host (e.g. x86 on x86_64) is not a cross build.
+func IsCross(hostarch Arch, buildarch Arch) bool {
+	for _, a := range buildarch.RunsOn() {
+		if a == hostarch {
+			return false
+		}
+	}
+	return true
+}
+
 // Preprocess preprocesses a RawPackageGenerator into a PackageGenerator.
+// If the build is a cross build and the pkgen does not support cross compilation, ErrCrossUnsupported is returned.
+// The "include" template function is not available (see PreprocessWithTemplates).
 func (rpg *RawPackageGenerator) Preprocess(hostarch Arch, buildarch Arch, bootstrap bool) (*PackageGenerator, error) {
+	return rpg.PreprocessWithTemplates(hostarch, buildarch, bootstrap, nil)
+}
+
+// PreprocessWithTemplates preprocesses a RawPackageGenerator into a PackageGenerator.
+// Template snippets for the "include" template function are loaded with templates.
+func (rpg *RawPackageGenerator) PreprocessWithTemplates(hostarch Arch, buildarch Arch, bootstrap bool, templates TemplateLoader) (*PackageGenerator, error) {
+	env := tmplEnv{
+		hostarch:  hostarch,
+		buildarch: buildarch,
+		templates: templates,
+	}
+	if IsCross(hostarch, buildarch) && !rpg.Cross {
+		return nil, ErrCrossUnsupported
+	}
 	pg := new(PackageGenerator)
 	pg.Packages = make(map[string]Package)
 	for n, p := range rpg.Packages {
@@ -71,27 +116,35 @@ func (rpg *RawPackageGenerator) Preprocess(hostarch Arch, buildarch Arch, bootst
 	pg.HostArch = hostarch
 	pg.BuildArch = buildarch
 	pg.Version = fmt.Sprintf("%s-%d", rpg.Version, rpg.Build)
-	pg.Sources = make([]*url.URL, len(rpg.Sources))
+	if rpg.Epoch > 0 {
+		pg.Version = fmt.Sprintf("%d:%s", rpg.Epoch, pg.Version)
+	}
+	pg.Sources = make([]*url.URL, 0, len(rpg.Sources))
 	for i, v := range rpg.Sources {
-		vpp, err := rpg.tmpl(fmt.Sprintf("src-%d", i), v, buildarch, hostarch)
+		vpp, err := rpg.tmpl(fmt.Sprintf("src-%d", i), v, env)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("sources[%d]: %s", i, err.Error())
+		}
+		vpp = strings.TrimSpace(vpp)
+		if vpp == "" {
+			// source omitted by template
+			continue
 		}
 		u, err := url.Parse(vpp)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("sources[%d]: %s", i, err.Error())
 		}
-		pg.Sources[i] = u
+		pg.Sources = append(pg.Sources, u)
 	}
-	script, err := rpg.tmpl("script", strings.Join(rpg.Script, "\n"), buildarch, hostarch)
+	script, err := rpg.tmpl("script", strings.Join(rpg.Script, "\n"), env)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("script: %s", err.Error())
 	}
 	pg.Script = strings.Split(script, "\n")
 	pg.BuildDependencies = rpg.BuildDependencies
 	pg.Builder, err = ParseBuilder(rpg.Builder)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("builder %q: %s", rpg.Builder, err.Error())
 	}
 	if pg.Builder.IsBootstrap() && !bootstrap {
 		pg.Builder = BuilderDefault
@@ -101,10 +154,26 @@ func (rpg *RawPackageGenerator) Preprocess(hostarch Arch, buildarch Arch, bootst
 	return pg, nil
 }
 
+// tmplEnv is the environment used when preprocessing templates.
+type tmplEnv struct {
+	hostarch  Arch
+	buildarch Arch
+
+	// templates is the TemplateLoader used by "include".
+	templates TemplateLoader
+
+	// depth is the include depth.
+	depth int
+}
+
 // tmpl preprocesses a value with text/template.
-func (rpg *RawPackageGenerator) tmpl(name string, in string, buildarch Arch, hostarch Arch) (string, error) {
+func (rpg *RawPackageGenerator) tmpl(name string, in string, env tmplEnv) (string, error) {
+	buildarch, hostarch := env.buildarch, env.hostarch
 	var fnm template.FuncMap
 	fnm = template.FuncMap{
+		"include": func(name string) (string, error) {
+			return rpg.include(name, env)
+		},
 		"extract": func(name string, ext string) string {
 			return strings.Join(
 				[]string{
@@ -146,10 +215,30 @@ func (rpg *RawPackageGenerator) tmpl(name string, in string, buildarch Arch, hos
 		"buildarch": func() Arch {
 			return buildarch
 		},
+		"iscross": func() bool {
+			return IsCross(hostarch, buildarch)
+		},
+		"archeq": func(a Arch, b Arch) bool {
+			// normalize aliases (e.g. "amd64")
+			if pa, err := ParseArch(string(a)); err == nil {
+				a = pa
+			}
+			if pb, err := ParseArch(string(b)); err == nil {
+				b = pb
+			}
+			return a == b
+		},
 		"confflags": func() string {
-			return fmt.Sprintf("--build %s-pc-linux-musl --host %s-pc-linux-musl", buildarch.AutoTools(), hostarch.AutoTools())
+			// autotools calls the machine compiling "build", and the machine the output runs on "host"
+			return fmt.Sprintf("--build %s-pc-linux-musl --host %s-pc-linux-musl", hostarch.AutoTools(), buildarch.AutoTools())
 		},
 	}
+	// add sprig functions without shadowing the pkgen functions
+	for k, v := range sprigFuncs {
+		if _, ok := fnm[k]; !ok {
+			fnm[k] = v
+		}
+	}
 	tmpl, err := template.New(name).Funcs(fnm).Parse(in)
 	if err != nil {
 		return "", err
@@ -0,0 +1,194 @@
+package pkgen
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+func TestPreprocessCross(t *testing.T) {
+	rpg := &RawPackageGenerator{
+		Packages: map[string]Package{"example": {}},
+		Version:  "1.0",
+		Script:   []string{"{{confflags}}"},
+		Cross:    true,
+	}
+	pg, err := rpg.Preprocess(Archx86_64, Archaarch64, false)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+		return
+	}
+	if pg.HostArch != Archx86_64 || pg.BuildArch != Archaarch64 {
+		t.Errorf("expected host x86_64 and build aarch64 but got %q and %q", pg.HostArch, pg.BuildArch)
+	}
+	expect := "--build x86_64-pc-linux-musl --host aarch64-pc-linux-musl"
+	if script := strings.Join(pg.Script, "\n"); script != expect {
+		t.Errorf("expected %q but got %q", expect, script)
+	}
+
+	rpg.Cross = false
+	_, err = rpg.Preprocess(Archx86_64, Archaarch64, false)
+	if err != ErrCrossUnsupported {
+		t.Errorf("expected ErrCrossUnsupported but got %v", err)
+	}
+
+	// x86 runs on x86_64, so this is not a cross build
+	_, err = rpg.Preprocess(Archx86_64, Archx86, false)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+}
+
+func TestPreprocessEpoch(t *testing.T) {
+	tbl := []struct {
+		epoch   uint
+		version string
+	}{
+		{0, "1.0-2"},
+		{3, "3:1.0-2"},
+	}
+	for _, v := range tbl {
+		rpg := &RawPackageGenerator{
+			Packages: map[string]Package{"example": {}},
+			Version:  "1.0",
+			Build:    2,
+			Epoch:    v.epoch,
+		}
+		pg, err := rpg.Preprocess(Archx86_64, Archx86_64, false)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err.Error())
+			continue
+		}
+		if pg.Version != v.version {
+			t.Errorf("expected version %q but got %q", v.version, pg.Version)
+		}
+	}
+}
+
+func TestPreprocessInclude(t *testing.T) {
+	tl := VFSTemplateLoader(mapfs.New(map[string]string{
+		"autotools-build": "{{configure \"example\"}}\nmake -C example",
+		"recursive":       "{{include \"recursive\"}}",
+	}))
+	rpg := &RawPackageGenerator{
+		Packages: map[string]Package{"example": {}},
+		Version:  "1.0",
+		Script:   []string{"{{include \"autotools-build\"}}"},
+	}
+	pg, err := rpg.PreprocessWithTemplates(Archx86_64, Archx86_64, false, tl)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(pg.Script) != 2 || !strings.HasPrefix(pg.Script[0], "(cd example && ./configure") || pg.Script[1] != "make -C example" {
+		t.Errorf("unexpected script %q", pg.Script)
+	}
+
+	for _, v := range []string{
+		`{{include "missing"}}`,
+		`{{include "../raw.go"}}`,
+		`{{include "recursive"}}`,
+	} {
+		rpg.Script = []string{v}
+		_, err = rpg.PreprocessWithTemplates(Archx86_64, Archx86_64, false, tl)
+		if err == nil {
+			t.Errorf("expected error for %s", v)
+		}
+	}
+	rpg.Script = []string{`{{include "autotools-build"}}`}
+	_, err = rpg.Preprocess(Archx86_64, Archx86_64, false)
+	if err == nil {
+		t.Error("expected error without template loader")
+	}
+}
+
+func TestPreprocessSprig(t *testing.T) {
+	rpg := &RawPackageGenerator{
+		Packages: map[string]Package{"example": {}},
+		Version:  " 1.0 ",
+		Sources:  []string{`https://example.com/{{lower "Example"}}-{{trim .Version}}.tar.gz`},
+		Script:   []string{`{{configure "example"}}`},
+	}
+	pg, err := rpg.Preprocess(Archx86_64, Archx86_64, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(pg.Sources) != 1 || pg.Sources[0].String() != "https://example.com/example-1.0.tar.gz" {
+		t.Errorf("unexpected sources %v", pg.Sources)
+	}
+	// sprig does not shadow pkgen functions
+	if len(pg.Script) != 1 || !strings.Contains(pg.Script[0], "--prefix=/usr") {
+		t.Errorf("unexpected script %q", pg.Script)
+	}
+
+	// functions which access the host or are not repeatable are unavailable
+	for _, fn := range []string{"env", "expandenv", "now", "randAlphaNum", "uuidv4", "shuffle"} {
+		rpg.Script = []string{`{{` + fn + ` "x"}}`}
+		_, err = rpg.Preprocess(Archx86_64, Archx86_64, false)
+		if err == nil || !strings.Contains(err.Error(), "not defined") {
+			t.Errorf("expected %q to be undefined but got %v", fn, err)
+		}
+	}
+}
+
+func TestPreprocessConditionalSource(t *testing.T) {
+	rpg := &RawPackageGenerator{
+		Packages: map[string]Package{"example": {}},
+		Version:  "1.0",
+		Sources: []string{
+			"https://example.com/example-{{.Version}}.tar.gz",
+			`{{ if eq (buildarch) "aarch64" }}https://example.com/aarch64.patch{{ end }}`,
+		},
+		Script: []string{"true"},
+		Cross:  true,
+	}
+	if err := rpg.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %s", err.Error())
+	}
+	tbl := []struct {
+		arch    Arch
+		sources int
+	}{
+		{Archx86_64, 1},
+		{Archaarch64, 2},
+	}
+	for _, v := range tbl {
+		pg, err := rpg.Preprocess(Archx86_64, v.arch, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if len(pg.Sources) != v.sources {
+			t.Errorf("expected %d sources for %s but got %v", v.sources, v.arch, pg.Sources)
+		}
+	}
+}
+
+func TestPreprocessIsCross(t *testing.T) {
+	rpg := &RawPackageGenerator{
+		Packages: map[string]Package{"example": {}},
+		Version:  "1.0",
+		Script: []string{
+			`{{if iscross}}cross{{else}}native{{end}}`,
+			`{{if archeq (buildarch) "arm64"}}arm{{else}}other{{end}}`,
+		},
+		Cross: true,
+	}
+	tbl := []struct {
+		hostarch, buildarch Arch
+		script              []string
+	}{
+		{Archx86_64, Archx86_64, []string{"native", "other"}},
+		{Archx86_64, Archaarch64, []string{"cross", "arm"}},
+		{Archaarch64, Archaarch64, []string{"native", "arm"}},
+		{Archx86_64, Archx86, []string{"native", "other"}},
+	}
+	for _, v := range tbl {
+		pg, err := rpg.Preprocess(v.hostarch, v.buildarch, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if strings.Join(pg.Script, "\n") != strings.Join(v.script, "\n") {
+			t.Errorf("expected %q for %s->%s but got %q", v.script, v.hostarch, v.buildarch, pg.Script)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"net/url"
 	"sort"
+	"sync"
 )
 
 // Loader is an interface for source loaders.
@@ -88,6 +89,67 @@ var ErrExceedsMaxBuffer = errors.New("resource exceeds maximum buffer size")
 type lenBufferLoader struct {
 	Loader
 	maxBuffer int64
+
+	// budget is an optional memory budget shared by all buffered Gets.
+	budget *bufferBudget
+}
+
+// bufferBudget is a byte budget shared between concurrent buffers.
+type bufferBudget struct {
+	lck  sync.Mutex
+	max  int64
+	used int64
+}
+
+// reserve attempts to reserve n bytes from the budget.
+// Returns false if the reservation would exceed the budget.
+func (bb *bufferBudget) reserve(n int64) bool {
+	bb.lck.Lock()
+	defer bb.lck.Unlock()
+	if bb.used+n > bb.max {
+		return false
+	}
+	bb.used += n
+	return true
+}
+
+// release returns n bytes to the budget.
+func (bb *bufferBudget) release(n int64) {
+	bb.lck.Lock()
+	defer bb.lck.Unlock()
+	bb.used -= n
+}
+
+// budgetBuffer is a bytes.Buffer which reserves space from a bufferBudget as it grows.
+// The bytes.Buffer is not embedded, as io.Copy would bypass Write using ReadFrom.
+type budgetBuffer struct {
+	buf      bytes.Buffer
+	budget   *bufferBudget
+	reserved int64
+}
+
+func (bb *budgetBuffer) Write(dat []byte) (int, error) {
+	if !bb.budget.reserve(int64(len(dat))) {
+		return 0, ErrExceedsMaxBuffer
+	}
+	bb.reserved += int64(len(dat))
+	return bb.buf.Write(dat)
+}
+
+func (bb *budgetBuffer) Read(dat []byte) (int, error) {
+	return bb.buf.Read(dat)
+}
+
+// Len returns the number of unread bytes in the buffer.
+func (bb *budgetBuffer) Len() int {
+	return bb.buf.Len()
+}
+
+// Close releases the reserved space back to the budget.
+func (bb *budgetBuffer) Close() error {
+	bb.budget.release(bb.reserved)
+	bb.reserved = 0
+	return nil
 }
 
 func (lbl *lenBufferLoader) Get(ctx context.Context, u *url.URL) (n int64, rc io.ReadCloser, err error) {
@@ -101,6 +163,8 @@ func (lbl *lenBufferLoader) Get(ctx context.Context, u *url.URL) (n int64, rc io
 	defer func() {
 		cerr := r.Close()
 		if cerr != nil && err == nil {
+			// release the buffer (and any budget reserved by it)
+			rc.Close()
 			err = cerr
 			n = 0
 			rc = nil
@@ -108,11 +172,25 @@ func (lbl *lenBufferLoader) Get(ctx context.Context, u *url.URL) (n int64, rc io
 	}()
 
 	// copy to buffer
-	var buf bytes.Buffer
 	lr := io.LimitedReader{
 		R: r,
 		N: lbl.maxBuffer,
 	}
+	if lbl.budget != nil {
+		buf := &budgetBuffer{budget: lbl.budget}
+		_, err = io.Copy(buf, &lr)
+		if err == nil && lr.N <= 0 {
+			err = ErrExceedsMaxBuffer
+		}
+		if err != nil {
+			buf.Close()
+			return 0, nil, err
+		}
+
+		// the space is released when the buffer is closed
+		return int64(buf.Len()), buf, nil
+	}
+	var buf bytes.Buffer
 	_, err = io.Copy(&buf, &lr)
 	if err != nil {
 		return 0, nil, err
@@ -138,3 +216,18 @@ func BufferLoader(loader Loader, maxBuffer int64) Loader {
 		maxBuffer: maxBuffer,
 	}
 }
+
+// SharedBufferLoader returns a Loader that will always provide a length, like BufferLoader.
+// Unlike BufferLoader, the total size of all in-flight buffers is limited to budget bytes.
+// The space used by a buffer is released when the returned io.ReadCloser is closed.
+// If buffering a resource would exceed the budget, Get returns ErrExceedsMaxBuffer rather than blocking.
+func SharedBufferLoader(loader Loader, maxBuffer int64, budget int64) Loader {
+	if lbl, ok := loader.(*lenBufferLoader); ok {
+		loader = lbl.Loader
+	}
+	return &lenBufferLoader{
+		Loader:    loader,
+		maxBuffer: maxBuffer,
+		budget:    &bufferBudget{max: budget},
+	}
+}
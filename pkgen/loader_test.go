@@ -0,0 +1,111 @@
+package pkgen
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// unsizedLoader is a Loader which returns sources of a fixed size without a length.
+type unsizedLoader struct {
+	size int
+}
+
+func (ul unsizedLoader) SupportedProtocols() ([]string, error) {
+	return []string{"test"}, nil
+}
+
+func (ul unsizedLoader) Get(ctx context.Context, u *url.URL) (int64, io.ReadCloser, error) {
+	return -1, ioutil.NopCloser(bytes.NewReader(make([]byte, ul.size))), nil
+}
+
+// errCloser is an io.ReadCloser which fails to close.
+type errCloser struct {
+	io.Reader
+}
+
+func (ec errCloser) Close() error {
+	return errCloseFailed
+}
+
+var errCloseFailed = errors.New("close failed")
+
+// closeFailLoader is a Loader which returns sources without a length, which fail to close.
+type closeFailLoader struct {
+	unsizedLoader
+}
+
+func (cfl closeFailLoader) Get(ctx context.Context, u *url.URL) (int64, io.ReadCloser, error) {
+	return -1, errCloser{bytes.NewReader(make([]byte, cfl.size))}, nil
+}
+
+func TestSharedBufferLoaderCloseError(t *testing.T) {
+	l := SharedBufferLoader(closeFailLoader{unsizedLoader{size: 1000}}, 2000, 4000)
+	for i := 0; i < 8; i++ {
+		_, rc, err := l.Get(context.Background(), &url.URL{Scheme: "test", Path: "/src"})
+		if err != errCloseFailed {
+			t.Fatalf("expected close error but got %v", err)
+		}
+		if rc != nil {
+			t.Fatal("expected no reader on close error")
+		}
+	}
+	if bb := l.(*lenBufferLoader).budget; bb.used != 0 {
+		t.Errorf("expected budget to be released but %d bytes are in use", bb.used)
+	}
+}
+
+func TestSharedBufferLoader(t *testing.T) {
+	const size = 1000
+	const budget = 4500
+	l := SharedBufferLoader(unsizedLoader{size: size}, 2*size, budget)
+	u := &url.URL{Scheme: "test", Path: "/src"}
+
+	var lck sync.Mutex
+	var total int64
+	var rcs []io.ReadCloser
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, rc, err := l.Get(context.Background(), u)
+			if err != nil {
+				if err != ErrExceedsMaxBuffer {
+					t.Errorf("unexpected error: %s", err.Error())
+				}
+				return
+			}
+			lck.Lock()
+			defer lck.Unlock()
+			total += n
+			rcs = append(rcs, rc)
+		}()
+	}
+	wg.Wait()
+	if total > budget {
+		t.Errorf("buffered %d bytes with a budget of %d", total, budget)
+	}
+	if len(rcs) != budget/size {
+		t.Errorf("expected %d successful gets but got %d", budget/size, len(rcs))
+	}
+
+	// closing the buffers releases the budget
+	for _, rc := range rcs {
+		rc.Close()
+	}
+	bb := l.(*lenBufferLoader).budget
+	if bb.used != 0 {
+		t.Errorf("expected budget to be released but %d bytes are in use", bb.used)
+	}
+	_, rc, err := l.Get(context.Background(), u)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	rc.Close()
+}
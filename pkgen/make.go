@@ -15,6 +15,7 @@ type MakeVars struct {
 	TarOut    makefile.MakeVar // variable with path to the tar output directory
 	HostArch  makefile.MakeVar // variable with host arch
 	BuildArch makefile.MakeVar // variable with build arch
+	Jobs      makefile.MakeVar // variable with number of parallel jobs (passed to make commands in the script)
 }
 
 // InitializeVars adds variable initialization of MakeVars to a Makefile.
@@ -29,6 +30,7 @@ func (pg *PackageGenerator) InitializeVars(mv MakeVars, b *makefile.Builder) {
 	b.SetVar(mv.TarOut, makefile.FilePath("tars"))
 	b.SetVar(mv.HostArch, pg.HostArch)
 	b.SetVar(mv.BuildArch, pg.BuildArch)
+	b.SetVar(mv.Jobs, makefile.RawText("1"))
 }
 
 // DefaultVars is the default MakeVars.
@@ -37,6 +39,7 @@ var DefaultVars = MakeVars{
 	TarOut:    "TAROUT",
 	HostArch:  "HOSTARCH",
 	BuildArch: "BUILDARCH",
+	Jobs:      "JOBS",
 }
 
 // dirRule creates a Makefile rule for creating a directory.
@@ -52,6 +55,44 @@ func dirRule(b *makefile.Builder, dirname makefile.Text) *makefile.Rule {
 	return r
 }
 
+// phonyList is a list of phony Makefile targets.
+type phonyList []string
+
+// rule creates a new phony rule in the Makefile.
+func (pl *phonyList) rule(b *makefile.Builder, name string) *makefile.Rule {
+	*pl = append(*pl, name)
+	return b.NewRule(makefile.RawText(name))
+}
+
+// appendTo adds a .PHONY rule with the targets to the Makefile.
+// Duplicate targets are only listed once, and no rule is added if there are no targets.
+func (pl phonyList) appendTo(b *makefile.Builder) {
+	if len(pl) == 0 {
+		return
+	}
+	r := b.NewRule(makefile.RawText(".PHONY"))
+	found := map[string]struct{}{}
+	for _, v := range pl {
+		if _, ok := found[v]; ok {
+			continue
+		}
+		found[v] = struct{}{}
+		r.AddDep(makefile.RawText(v))
+	}
+}
+
+// filesCmd generates a shell command which moves files matching a glob from the stage directory into the package directory.
+// Directory structure relative to the stage directory is preserved.
+// If no files match the glob, the command does nothing.
+func filesCmd(stage string, pkgdir string, glob string) string {
+	return fmt.Sprintf(
+		`for f in %s; do if [ -e "$$f" ]; then mkdir -p "%s/$$(dirname "$${f#%s/}")" && mv "$$f" "%s/$${f#%s/}"; fi; done`,
+		path.Join(stage, glob),
+		pkgdir, stage,
+		pkgdir, stage,
+	)
+}
+
 // GenMakeInfoComment generates a Makefile comment with pretty-printed info.
 func (pg *PackageGenerator) GenMakeInfoComment(b *makefile.Builder) {
 	infotitle := "Package Information"
@@ -81,7 +122,9 @@ func (pg *PackageGenerator) GenMake(mv MakeVars, b *makefile.Builder) {
 	st := makefile.RawText("script")
 	ot := makefile.FilePath("out")
 	srct := makefile.FilePath("src")
+	stgt := makefile.FilePath("stage")
 	uts := makefile.RawText("untarsource")
+	ft := makefile.RawText("files")
 
 	// sections
 	basics := b.SectionBuilder()
@@ -89,9 +132,11 @@ func (pg *PackageGenerator) GenMake(mv MakeVars, b *makefile.Builder) {
 	dirsec.Comment().Line("Directory structure rules")
 
 	// basics
-	trule := basics.NewRule(makefile.RawText("gentars")).Phony()
-	pkginfos := basics.NewRule(makefile.RawText("pkginfos")).Phony()
-	defer basics.AppendPhony()
+	var phony phonyList
+	defer func() { phony.appendTo(basics) }()
+	trule := phony.rule(basics, "gentars")
+	pkginfos := phony.rule(basics, "pkginfos")
+	frule := phony.rule(basics, ft.Convert()).AddDep(st)
 
 	// put basic directory structure
 	dirRule(dirsec, srct)
@@ -137,7 +182,7 @@ func (pg *PackageGenerator) GenMake(mv MakeVars, b *makefile.Builder) {
 			tname,
 		)
 		b.NewRule(trname).
-			AddDep(st).
+			AddDep(ft).
 			AddDep(mv.TarOut.Sub()).
 			Print(makefile.JoinText(" ",
 				makefile.RawText("TAR"),
@@ -151,6 +196,11 @@ func (pg *PackageGenerator) GenMake(mv MakeVars, b *makefile.Builder) {
 			AddArg(makefile.RawText(".")).
 			SetNoPrint()
 		trule.AddDep(trname)
+
+		// add file moving commands
+		for _, f := range pg.Packages[p].Files {
+			frule.NewCmd(filesCmd(stgt.Convert(), path.Join(ot.Convert(), p), f))
+		}
 	}
 
 	// add rule to un-tar source
@@ -173,16 +223,56 @@ func (pg *PackageGenerator) GenMake(mv MakeVars, b *makefile.Builder) {
 			),
 		)
 
+	// add source verification rule
+	vr := phony.rule(basics, "verify").
+		AddDep(uts)
+	for _, s := range pg.Sources {
+		sum := s.Query().Get("sha256sum")
+		if sum == "" {
+			continue
+		}
+		name := path.Base(s.Path)
+		vr.Print(makefile.JoinText(" ",
+			makefile.RawText("VERIFY"),
+			makefile.FilePath(name),
+		)).
+			NewCmd(fmt.Sprintf("echo %s | sha256sum -c -", shellQuote(sum+"  "+path.Join(srct.Convert(), name)))).
+			SetNoPrint()
+	}
+
 	// add script rule
 	sr := b.NewRule(st).
 		OneShell().
 		AddDep(uts).
+		AddDep(makefile.RawText("verify")).
 		AddDep(makefile.RawText("pkginfos"))
 	sr.NewCmd("set -ex")
+	// keep the flags inherited from the outer make
+	sr.NewCmd(fmt.Sprintf(`export MAKEFLAGS="$$MAKEFLAGS -j%s"`, mv.Jobs.Sub().Convert()))
 	for _, l := range pg.Script {
 		sr.NewCmd(l)
 	}
 
+	// add clean rules
+	phony.rule(basics, "clean").
+		Print(makefile.RawText("CLEAN")).
+		NewCmd("rm").
+		AddArg(makefile.RawText("-rf")).
+		AddArg(ot).
+		AddArg(srct).
+		AddArg(stgt).
+		AddArg(mv.TarOut.Sub()).
+		AddArg(mv.SrcTar.Sub()).
+		AddArg(makefile.FilePath("pkgs.tar")).
+		SetNoPrint()
+	phony.rule(basics, "distclean").
+		AddDep(makefile.RawText("clean")).
+		Print(makefile.RawText("DISTCLEAN")).
+		NewCmd("rm").
+		AddArg(makefile.RawText("-f")).
+		AddArg(makefile.FilePath("Makefile")).
+		SetNoPrint()
+
 	// add pkgs.tar rule
 	b.NewRule(makefile.FilePath("pkgs.tar")).
 		AddDep(makefile.RawText("gentars")).
@@ -224,3 +314,11 @@ func (pg *PackageGenerator) GenFullMakefile(mv MakeVars) *makefile.Builder {
 	pg.GenMake(mv, buildsection)
 	return b
 }
+
+// shellQuote quotes a string as a single shell word for use in a make command.
+func shellQuote(s string) string {
+	s = "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+
+	// escape make variable references
+	return strings.Replace(s, "$", "$$", -1)
+}
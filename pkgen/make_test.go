@@ -0,0 +1,185 @@
+package pkgen
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	makefile "gitlab.com/panux/go-makefile"
+)
+
+// genTestMakefile generates a Makefile from a minimal pkgen.
+func genTestMakefile(t *testing.T, rpg *RawPackageGenerator) string {
+	if rpg == nil {
+		rpg = &RawPackageGenerator{
+			Packages: map[string]Package{"example": {}},
+			Version:  "1.0",
+			Script:   []string{"make"},
+		}
+	}
+	pg, err := rpg.Preprocess(Archx86_64, Archx86_64, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var buf bytes.Buffer
+	_, err = pg.GenFullMakefile(DefaultVars).WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	return buf.String()
+}
+
+// findLine finds the first line of the Makefile containing all of the given strings.
+func findLine(mf string, strs ...string) (string, bool) {
+lloop:
+	for _, l := range strings.Split(mf, "\n") {
+		for _, s := range strs {
+			if !strings.Contains(l, s) {
+				continue lloop
+			}
+		}
+		return l, true
+	}
+	return "", false
+}
+
+func TestGenMakeClean(t *testing.T) {
+	mf := genTestMakefile(t, nil)
+	if _, ok := findLine(mf, ".PHONY:", "clean", "distclean"); !ok {
+		t.Errorf("clean and distclean not marked phony in:\n%s", mf)
+	}
+	if _, ok := findLine(mf, "rm -rf", "out", "src", "$(TAROUT)", "$(SRCTAR)", "pkgs.tar"); !ok {
+		t.Errorf("missing clean command in:\n%s", mf)
+	}
+	if _, ok := findLine(mf, "rm -f", "Makefile"); !ok {
+		t.Errorf("missing distclean command in:\n%s", mf)
+	}
+}
+
+func TestGenMakeJobs(t *testing.T) {
+	mf := genTestMakefile(t, &RawPackageGenerator{
+		Packages: map[string]Package{"example": {}},
+		Version:  "1.0",
+		Script:   []string{"make"},
+	})
+	if _, ok := findLine(mf, "JOBS", "1"); !ok {
+		t.Errorf("JOBS not declared in:\n%s", mf)
+	}
+	if _, ok := findLine(mf, `export MAKEFLAGS="$$MAKEFLAGS -j$(JOBS)"`); !ok {
+		t.Errorf("JOBS not referenced in:\n%s", mf)
+	}
+}
+
+func TestGenMakeVerify(t *testing.T) {
+	sum := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	mf := genTestMakefile(t, &RawPackageGenerator{
+		Packages: map[string]Package{"example": {}},
+		Version:  "1.0",
+		Sources: []string{
+			"https://example.com/example-{{.Version}}.tar.gz?sha256sum=" + sum,
+			"https://example.com/unhashed.tar.gz",
+			"https://example.com/it's-$HOME.tar.gz?sha256sum=" + sum,
+		},
+		Script: []string{"make"},
+	})
+	if _, ok := findLine(mf, ".PHONY:", "verify"); !ok {
+		t.Errorf("verify not marked phony in:\n%s", mf)
+	}
+	if _, ok := findLine(mf, "script:", "verify"); !ok {
+		t.Errorf("script does not depend on verify in:\n%s", mf)
+	}
+	if _, ok := findLine(mf, sum+"  src/example-1.0.tar.gz", "sha256sum -c"); !ok {
+		t.Errorf("missing checksum command in:\n%s", mf)
+	}
+	if _, ok := findLine(mf, `echo '`+sum+`  src/it'\''s-$$HOME.tar.gz' | sha256sum -c -`); !ok {
+		t.Errorf("checksum command not quoted in:\n%s", mf)
+	}
+	if _, ok := findLine(mf, "unhashed.tar.gz", "sha256sum"); ok {
+		t.Errorf("unexpected checksum command for unhashed source in:\n%s", mf)
+	}
+}
+
+func TestGenMakePhony(t *testing.T) {
+	mf := genTestMakefile(t, nil)
+	n := 0
+	for _, l := range strings.Split(mf, "\n") {
+		if !strings.HasPrefix(l, ".PHONY:") {
+			continue
+		}
+		n++
+		found := map[string]bool{}
+		for _, v := range strings.Fields(strings.TrimPrefix(l, ".PHONY:")) {
+			if found[v] {
+				t.Errorf("duplicate phony target %q in %q", v, l)
+			}
+			found[v] = true
+		}
+		for _, v := range []string{"gentars", "pkginfos", "verify", "clean", "distclean"} {
+			if !found[v] {
+				t.Errorf("target %q missing from %q", v, l)
+			}
+		}
+	}
+	if n != 1 {
+		t.Errorf("expected exactly one .PHONY rule but found %d in:\n%s", n, mf)
+	}
+}
+
+func TestPhonyListEmpty(t *testing.T) {
+	b := makefile.NewBuilder()
+	phonyList(nil).appendTo(b)
+	var buf bytes.Buffer
+	_, err := b.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if strings.Contains(buf.String(), ".PHONY") {
+		t.Errorf("unexpected .PHONY in %q", buf.String())
+	}
+}
+
+func TestGenMakeFiles(t *testing.T) {
+	mf := genTestMakefile(t, &RawPackageGenerator{
+		Packages: map[string]Package{
+			"example-dev": {Files: []string{"usr/include/*", "usr/lib/*.a"}},
+			"example":     {Files: []string{"usr/lib/*"}},
+		},
+		Version: "1.0",
+		Script:  []string{"make DESTDIR=$(CURDIR)/stage install"},
+	})
+	expect := []string{
+		`for f in stage/usr/lib/*; do if [ -e "$$f" ]; then mkdir -p "out/example/$$(dirname "$${f#stage/}")" && mv "$$f" "out/example/$${f#stage/}"; fi; done`,
+		`for f in stage/usr/include/*; do if [ -e "$$f" ]; then mkdir -p "out/example-dev/$$(dirname "$${f#stage/}")" && mv "$$f" "out/example-dev/$${f#stage/}"; fi; done`,
+		`for f in stage/usr/lib/*.a; do if [ -e "$$f" ]; then mkdir -p "out/example-dev/$$(dirname "$${f#stage/}")" && mv "$$f" "out/example-dev/$${f#stage/}"; fi; done`,
+	}
+	pos := -1
+	for _, e := range expect {
+		i := strings.Index(mf, e)
+		if i == -1 {
+			t.Errorf("missing command %q in:\n%s", e, mf)
+			continue
+		}
+		if i < pos {
+			t.Errorf("command %q out of order in:\n%s", e, mf)
+		}
+		pos = i
+	}
+	if _, ok := findLine(mf, "files:", "script"); !ok {
+		t.Errorf("files rule does not depend on script in:\n%s", mf)
+	}
+	if _, ok := findLine(mf, "example.tar.gz:", "files"); !ok {
+		t.Errorf("tar rule does not depend on files in:\n%s", mf)
+	}
+}
+
+func TestGenMakeInfoEpoch(t *testing.T) {
+	mf := genTestMakefile(t, &RawPackageGenerator{
+		Packages: map[string]Package{"example": {}},
+		Version:  "1.0",
+		Epoch:    1,
+		Script:   []string{"make"},
+	})
+	if _, ok := findLine(mf, "Version: 1:1.0-0"); !ok {
+		t.Errorf("epoch missing from info comment in:\n%s", mf)
+	}
+}
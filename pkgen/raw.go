@@ -1,7 +1,10 @@
 package pkgen
 
 import (
+	"fmt"
 	"io"
+	"net/url"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -10,55 +13,69 @@ import (
 type RawPackageGenerator struct {
 	// Packages is the list of packages generated by this pkgen.
 	// Required.
-	Packages map[string]Package
+	Packages map[string]Package `yaml:"packages"`
 
 	// Arch is the set of supported architectures.
 	// Optional.
-	Arch ArchSet
+	Arch ArchSet `yaml:"arch,omitempty"`
 
 	// Version is the version of the package.
 	// Required.
-	Version string
+	Version string `yaml:"version"`
 
 	// Build is the build number (added to end of version).
 	// Optional.
-	Build uint
+	Build uint `yaml:"build,omitempty"`
+
+	// Epoch is the version epoch (added to start of version if non-zero).
+	// This can be incremented to force the package to be considered newer than previous versions.
+	// Optional.
+	Epoch uint `yaml:"epoch,omitempty"`
 
 	// Sources is a list of source URLs.
 	// These will be preprocessed using "text/template".
+	// Sources which evaluate to an empty string are omitted, so a source can be made conditional:
+	//	{{ if eq (buildarch) "aarch64" }}https://example.com/aarch64.patch{{ end }}
 	// Optional.
-	Sources []string
+	Sources []string `yaml:"sources,omitempty"`
 
 	// Script is the script used for building the package.
 	// This will be preprocessed using "text/template".
 	// Required.
-	Script []string
+	Script []string `yaml:"script"`
 
 	// BuildDependencies is the set of build dependencies.
 	// Required.
-	BuildDependencies []string
+	BuildDependencies []string `yaml:"builddependencies"`
 
 	// Builder is the system used to build the pkgen.
 	// Possible builders are: "bootstrap", "docker", or "default".
 	// Optional. Defaults to "default".
-	Builder string
+	Builder string `yaml:"builder,omitempty"`
 
 	// Cross indicates whether or not the package can be cross-compiled.
 	// Optional. Defaults to false.
-	Cross bool
+	Cross bool `yaml:"cross,omitempty"`
 
 	// Data is a set of user-defined data.
-	Data map[string]interface{}
+	Data map[string]interface{} `yaml:"data,omitempty"`
 
 	// NoBootstrap is an option to force-unbootstrap a dependency.
 	// Format: {"python":true}
-	NoBootstrap map[string]bool
+	NoBootstrap map[string]bool `yaml:"nobootstrap,omitempty"`
 }
 
 // Package is a package entry in a pkgen.
 type Package struct {
 	// Dependencies is the set of dependencies the package will have.
-	Dependencies []string
+	Dependencies []string `yaml:"dependencies,omitempty"`
+
+	// Files is a list of glob patterns for files to move from the staging directory into the package.
+	// Patterns are relative to the staging directory ("stage").
+	// Packages are processed in sorted order, and patterns in listed order.
+	// If multiple patterns match a file, the file is moved by the first match.
+	// Optional.
+	Files []string `json:",omitempty" yaml:"files,omitempty"`
 }
 
 // UnmarshalPkgen unmarshals a raw pkgen from YAML.
@@ -73,3 +90,76 @@ func UnmarshalPkgen(r io.Reader) (*RawPackageGenerator, error) {
 	}
 	return rpg, nil
 }
+
+// Marshal encodes the raw pkgen as YAML, which can be decoded with UnmarshalPkgen.
+// Fields are written in declaration order, packages are sorted by name, and empty optional fields are omitted.
+// Comments and formatting from the original YAML are not preserved.
+func (rpg *RawPackageGenerator) Marshal(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	err := enc.Encode(rpg)
+	if err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
+
+// UnmarshalPkgenStrict unmarshals a raw pkgen from YAML and validates it.
+// If validation fails, the returned error is a ValidationError.
+func UnmarshalPkgenStrict(r io.Reader) (*RawPackageGenerator, error) {
+	rpg, err := UnmarshalPkgen(r)
+	if err != nil {
+		return nil, err
+	}
+	err = rpg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return rpg, nil
+}
+
+// ValidationError is an error containing all problems found by RawPackageGenerator.Validate.
+type ValidationError []error
+
+func (ve ValidationError) Error() string {
+	strs := make([]string, len(ve))
+	for i, v := range ve {
+		strs[i] = v.Error()
+	}
+	return fmt.Sprintf("invalid pkgen: %s", strings.Join(strs, "; "))
+}
+
+// Validate checks that required fields are present and that fields are well-formed.
+// If any problems are found, a ValidationError listing them is returned.
+func (rpg *RawPackageGenerator) Validate() error {
+	var errs ValidationError
+	if len(rpg.Packages) == 0 {
+		errs = append(errs, fmt.Errorf("packages: no packages"))
+	}
+	if rpg.Version == "" {
+		errs = append(errs, fmt.Errorf("version: missing"))
+	}
+	if len(rpg.Script) == 0 {
+		errs = append(errs, fmt.Errorf("script: missing"))
+	}
+	if _, err := ParseBuilder(rpg.Builder); err != nil {
+		errs = append(errs, fmt.Errorf("builder %q: %s", rpg.Builder, err.Error()))
+	}
+	for i, v := range rpg.Sources {
+		if strings.Contains(v, "{{") {
+			// templated sources can only be checked after preprocessing
+			continue
+		}
+		u, err := url.Parse(v)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("sources[%d]: %s", i, err.Error()))
+		case u.Scheme == "":
+			errs = append(errs, fmt.Errorf("sources[%d]: %q is missing a protocol", i, v))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
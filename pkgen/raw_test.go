@@ -0,0 +1,127 @@
+package pkgen
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := `
+packages:
+  example:
+    dependencies: [musl]
+version: "1.0"
+sources:
+  - https://example.com/example-{{.Version}}.tar.gz
+script:
+  - make
+builddependencies: [build-meta]
+`
+	rpg, err := UnmarshalPkgenStrict(strings.NewReader(valid))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if rpg.Version != "1.0" {
+		t.Errorf("expected version 1.0 but got %q", rpg.Version)
+	}
+
+	tbl := []struct {
+		name   string
+		modify func(*RawPackageGenerator)
+		field  string
+	}{
+		{"packages", func(rpg *RawPackageGenerator) { rpg.Packages = nil }, "packages"},
+		{"version", func(rpg *RawPackageGenerator) { rpg.Version = "" }, "version"},
+		{"script", func(rpg *RawPackageGenerator) { rpg.Script = nil }, "script"},
+		{"builder", func(rpg *RawPackageGenerator) { rpg.Builder = "weird" }, "builder"},
+		{"source protocol", func(rpg *RawPackageGenerator) { rpg.Sources = []string{"example.tar.gz"} }, "sources[0]"},
+		{"source syntax", func(rpg *RawPackageGenerator) { rpg.Sources = []string{"https://exa mple.com/%zz"} }, "sources[0]"},
+	}
+	for _, v := range tbl {
+		rpg, err := UnmarshalPkgen(strings.NewReader(valid))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		v.modify(rpg)
+		err = rpg.Validate()
+		verr, ok := err.(ValidationError)
+		if !ok {
+			t.Errorf("%s: expected ValidationError but got %v", v.name, err)
+			continue
+		}
+		if len(verr) != 1 || !strings.HasPrefix(verr[0].Error(), v.field) {
+			t.Errorf("%s: expected one error for %s but got %v", v.name, v.field, verr)
+		}
+	}
+
+	// all problems are reported at once
+	err = (&RawPackageGenerator{}).Validate()
+	if verr, ok := err.(ValidationError); !ok || len(verr) != 3 {
+		t.Errorf("expected 3 errors but got %v", err)
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	src := `
+packages:
+  zlib:
+    dependencies: [musl]
+  zlib-dev:
+    dependencies: [zlib]
+    files: [usr/include, usr/lib/*.a]
+arch: [x86_64, aarch64]
+version: "1.2.11"
+build: 3
+sources:
+  - https://zlib.net/zlib-{{.Version}}.tar.xz
+  - file:///fix.patch
+script:
+  - "{{extract \"zlib\" \"xz\"}}"
+  - make
+builddependencies: [build-meta, xz]
+cross: true
+data:
+  url: https://zlib.net
+nobootstrap:
+  python: true
+`
+	rpg, err := UnmarshalPkgen(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var buf bytes.Buffer
+	err = rpg.Marshal(&buf)
+	if err != nil {
+		t.Fatalf("failed to marshal: %s", err.Error())
+	}
+	out := buf.String()
+	rpg2, err := UnmarshalPkgen(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to unmarshal output: %s\n%s", err.Error(), out)
+	}
+	if !reflect.DeepEqual(rpg, rpg2) {
+		t.Errorf("round trip changed pkgen: %#v != %#v", rpg, rpg2)
+	}
+
+	// output is canonical
+	buf.Reset()
+	err = rpg2.Marshal(&buf)
+	if err != nil {
+		t.Fatalf("failed to marshal: %s", err.Error())
+	}
+	if buf.String() != out {
+		t.Errorf("output changed on second marshal:\n%s\n%s", out, buf.String())
+	}
+
+	// fields are in declaration order and empty optionals are omitted
+	if !strings.HasPrefix(out, "packages:") || strings.Index(out, "version:") > strings.Index(out, "script:") {
+		t.Errorf("unexpected field order:\n%s", out)
+	}
+	for _, f := range []string{"epoch:", "builder:"} {
+		if strings.Contains(out, f) {
+			t.Errorf("expected %q to be omitted:\n%s", f, out)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package pkgen
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// TemplateLoader is an interface used to load shared template snippets for the "include" template function.
+type TemplateLoader interface {
+	// LoadTemplate loads the template snippet with the given name.
+	// If the snippet does not exist, an error satisfying os.IsNotExist should be returned.
+	LoadTemplate(name string) (string, error)
+}
+
+// ErrInvalidTemplateName is an error indicating that a template snippet name is not valid.
+var ErrInvalidTemplateName = errors.New("invalid template name")
+
+// validateTemplateName checks that a template name only contains [a-zA-Z0-9_-].
+// This prevents loading files outside of the template directory.
+func validateTemplateName(name string) error {
+	if name == "" {
+		return ErrInvalidTemplateName
+	}
+	for _, r := range name {
+		switch {
+		case 'a' <= r && r <= 'z':
+		case 'A' <= r && r <= 'Z':
+		case '0' <= r && r <= '9':
+		case r == '_' || r == '-':
+		default:
+			return ErrInvalidTemplateName
+		}
+	}
+	return nil
+}
+
+// vfsTemplateLoader is a TemplateLoader which loads snippets from a VFS.
+type vfsTemplateLoader struct {
+	fs vfs.FileSystem
+}
+
+func (tl vfsTemplateLoader) LoadTemplate(name string) (string, error) {
+	err := validateTemplateName(name)
+	if err != nil {
+		return "", fmt.Errorf("%s %q", err.Error(), name)
+	}
+	f, err := tl.fs.Open("/" + name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	dat, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return string(dat), nil
+}
+
+// VFSTemplateLoader returns a TemplateLoader which loads snippets from files in the root directory of a VFS.
+// The name of the file is the name of the snippet.
+// Names may only contain [a-zA-Z0-9_-], so files outside of the root directory cannot be loaded.
+func VFSTemplateLoader(fs vfs.FileSystem) TemplateLoader {
+	return vfsTemplateLoader{fs: fs}
+}
+
+// maxIncludeDepth is the maximum depth of nested includes.
+const maxIncludeDepth = 16
+
+// include loads and preprocesses a template snippet.
+func (rpg *RawPackageGenerator) include(name string, env tmplEnv) (string, error) {
+	if env.templates == nil {
+		return "", fmt.Errorf("cannot include %q: no template loader", name)
+	}
+	env.depth++
+	if env.depth > maxIncludeDepth {
+		return "", fmt.Errorf("cannot include %q: maximum include depth exceeded", name)
+	}
+	snippet, err := env.templates.LoadTemplate(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("template %q not found", name)
+		}
+		return "", err
+	}
+	return rpg.tmpl("include-"+name, snippet, env)
+}